@@ -1,181 +1,14 @@
 package main;
 
-import "encoding/json"
-import "crypto/sha256"
-import "crypto/ecdsa"
-import "crypto/x509"
-import "crypto/rand"
-import "io/ioutil"
 import "net/http"
-import "strings"
-import "bytes"
 import "time"
+import "strings"
+import "flag"
 import "sort"
 import "sync"
 import "fmt"
 import "os"
 
-func load_private_key() (*ecdsa.PrivateKey, error){
-    key_in_bytes, err:=ioutil.ReadFile("private.key")
-    if err!=nil{
-        return nil, err
-    }
-
-    return x509.ParseECPrivateKey(key_in_bytes)
-}
-
-func read_list_file(filename string) ([]string, error){
-    content, err:=ioutil.ReadFile(filename)
-    if err!=nil{
-        return nil, err
-    }
-
-    lines:=strings.Split(string(content), "\n")
-    return_strings:=make([]string, 0, len(lines))
-    for _,line :=range lines{
-        trimmed_line:=strings.TrimSpace(line)
-        if len(trimmed_line)==0{
-            continue
-        }
-
-        return_strings=append(return_strings, trimmed_line)
-    }
-
-    return return_strings, nil
-}
-
-type Work struct{
-    Hosts []string `json:"hosts"`
-    Work []struct{
-        Dir string `json:"dir"`
-        Command string `json:"command"`
-    } `json:"work"`
-}
-
-type InvalidJsonContent struct{}
-
-func (InvalidJsonContent) Error() string{
-    return "InvalidJsonContent"
-}
-
-func load_work() (Work, error){
-    var work Work
-    f,err:=os.Open("work.json")
-    defer f.Close()
-    if err!=nil{
-        return work, err
-    }
-
-    err=json.NewDecoder(f).Decode(&work)
-    if err!=nil{
-        return work, err
-    }
-
-    if len(work.Hosts)==0 || len(work.Work)==0{
-        return work, InvalidJsonContent{}
-    }
-
-    for _,inner_work := range work.Work{
-        if len(inner_work.Dir)==0 || len(inner_work.Command)==0{
-            return work, InvalidJsonContent{}
-        }
-    }
-
-    return work, nil
-}
-
-
-type MyClient struct{
-    client *http.Client
-}
-
-type StatusCodeIsNotOk struct{
-    content string
-    host string
-    code int
-}
-
-func (s StatusCodeIsNotOk) Error() string{
-    content:=""
-    host:=""
-    code:=""
-
-    if len(s.content)!=0{
-        content=fmt.Sprintf("(content=%s)", s.content)
-    }
-
-    if len(s.host)!=0{
-        host=fmt.Sprintf("(host=%s)", s.host)
-    }
-
-    if s.code!=0{
-        code=fmt.Sprintf("(code=%d)", s.code)
-    }
-
-    return fmt.Sprintf("StatusCodeIsNotOk%s%s%s", host, content, code)
-}
-
-func (c MyClient) is_host_busy(host string) (bool, error){
-    response, err:=c.client.Get(fmt.Sprintf("http://%s:4753/api/is_busy", host))
-    if err!=nil{
-        return false, err
-    }
-
-    if response.StatusCode!=200{
-        return false, StatusCodeIsNotOk{host: host, code: response.StatusCode}
-    }
-
-    var busy_message BusyMessage
-    err=json.NewDecoder(response.Body).Decode(&busy_message)
-    return busy_message.Busy, err
-}
-
-func (c MyClient) get_nonce(host string) (uint64, error){
-    response, err:=c.client.Get(fmt.Sprintf("http://%s:4753/api/get_nonce", host))
-    if err!=nil{
-        return 0, err
-    }
-
-    if response.StatusCode!=200{
-        return 0, StatusCodeIsNotOk{host: host, code: response.StatusCode}
-    }
-
-    var nonce_message NonceMessage
-    err=json.NewDecoder(response.Body).Decode(&nonce_message)
-    return nonce_message.Nonce, err
-}
-
-func (c MyClient) send_work(host string, work_path string, signature_r string, signature_s string) error{
-    command_message:=Command{
-        Work_path: work_path,
-        Signature_r: signature_r,
-        Signature_s: signature_s,
-    }
-
-    var buffer bytes.Buffer
-    err:=json.NewEncoder(&buffer).Encode(&command_message)
-    if err!=nil{
-        return err
-    }
-
-    response, err:=c.client.Post(fmt.Sprintf("http://%s:4753/api/work", host), "application/json", &buffer)
-    if err!=nil{
-        return err
-    }
-
-    if response.StatusCode!=200{
-        content, err:=ioutil.ReadAll(response.Body)
-        if err!=nil{
-            return StatusCodeIsNotOk{host: host, code: response.StatusCode, content: "Could not read: "+err.Error()}
-        }
-        response.Body.Close()
-
-        return StatusCodeIsNotOk{host: host, code: response.StatusCode, content: string(content)}
-    }
-
-    return nil
-}
-
 // func find_servers() []string{
 //     const PC_RANGE = 65
 //     client:=&http.Client{
@@ -211,9 +44,11 @@ func (c MyClient) send_work(host string, work_path string, signature_r string, s
 func try_access_host(client *http.Client, host_num int, wait_group *sync.WaitGroup, return_chan chan string){
     defer wait_group.Done()
 
+    // Any answer means a server is running there, rank_hosts finds out whether it speaks our protocol.
     host:=fmt.Sprintf("c%03d", host_num)
-    _, err:=client.Head(fmt.Sprintf("http://%s:4753/api/is_busy", host))
+    response, err:=client.Get(fmt.Sprintf("http://%s:4753/api/health", host))
     if err==nil{
+        response.Body.Close()
         return_chan<-host
     }
 }
@@ -248,80 +83,91 @@ func find_servers() []string{
 
 
 func main() {
+    log_format:=flag.String("log_format", LOG_FORMAT_TEXT, "log output format: text, json or logfmt")
+    workers:=flag.Int("workers", DEFAULT_WORKERS, "how many hosts to query and submit to at once")
+    wait:=flag.Bool("wait", false, "wait for all jobs to finish, print a report and exit non-zero if any failed")
+    scheduler_name:=flag.String("scheduler", SCHEDULER_LEAST_LOADED, "how to pick work and hosts: "+strings.Join(SCHEDULERS, ", "))
+    history_path:=flag.String("history", "scheduler_history.json", "file longest_job_first and sticky learn from earlier runs in")
+    state_path:=flag.String("state", "", "file to keep the run in, a restarted client skips finished jobs and follows running ones")
+    flag.Parse()
+    err:=set_log_format(*log_format)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error:", err)
+        exit_if_waiting(*wait)
+        return
+    }
+
     private_key,err:=load_private_key()
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error loading key:", err)
+        log_error("Error loading key", err)
+        exit_if_waiting(*wait)
         return
     }
 
-    work_paths, err:=read_list_file("work_paths.list")
+    work, err:=load_work_or_work_paths()
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error reading work paths:", err)
+        log_error("Error reading work", err)
+        exit_if_waiting(*wait)
         return
     }
 
     hosts:=find_servers()
     last_host_update_time:=time.Now()
-    fmt.Println("Found hosts:", hosts)
+    log_info("Found hosts", "servers", strings.Join(hosts, ","))
 
     inner_client:=&http.Client{
         Timeout: 5*time.Second,
     }
-    client:=MyClient{client: inner_client}
-
-    outer: for _,work_path:=range work_paths{
-        fmt.Println("Next to send:", work_path)
-        for{
-            if len(hosts)==0 || time.Now().After(last_host_update_time.Add(5*time.Minute)){
-                hosts=find_servers()
-                last_host_update_time=time.Now()
-                fmt.Println("Found hosts:", hosts)
-            }
-            for _,host:=range hosts{
-                busy,err:=client.is_host_busy(host)
-                if err!=nil{
-                    fmt.Fprintln(os.Stderr, "Error checking if host is busy:", err)
-                    continue
-                }
-
-                if busy{
-                    continue
-                }
-
-                nonce,err:=client.get_nonce(host)
-                if err!=nil{
-                    fmt.Fprintln(os.Stderr, "Error getting nonce:", err)
-                    continue
-                }
-
-                if nonce==0{
-                    fmt.Fprintln(os.Stderr, "Error: nonce is zero")
-                    continue
-                }
+    client:=MyClient{client: inner_client, private_key: private_key}
+    watcher:=new_event_watcher(client)
+    watcher.set_hosts(hosts)
 
-                string_to_sign:=fmt.Sprintf("$$%s$$%x$$", work_path, nonce)
-                hash_to_sign:=sha256.Sum256([]byte(string_to_sign))
-                r,s,err:=ecdsa.Sign(rand.Reader, private_key, hash_to_sign[:])
-                if err!=nil{
-                    fmt.Fprintln(os.Stderr, "Error signing:", err)
-                    continue
-                }
+    run_state:=RunState{path: *state_path}
+    state, err:=run_state.load()
+    if err!=nil{
+        log_error("Error reading state", err, "path", *state_path)
+        exit_if_waiting(*wait)
+        return
+    }
 
-                signature_r:=r.String()
-                signature_s:=s.String()
+    scheduler, err:=new_scheduler(*scheduler_name, *history_path)
+    if err!=nil{
+        log_error("Error setting up scheduler", err, "scheduler", *scheduler_name)
+        exit_if_waiting(*wait)
+        return
+    }
+    if *scheduler_name==SCHEDULER_LONGEST_JOB_FIRST && !*wait{
+        log_warning("longest_job_first only learns how long jobs take from those it follows, without -wait only entries with retries or dependents")
+    }
 
-                err=client.send_work(host, work_path, signature_r, signature_s)
-                if err!=nil{
-                    fmt.Fprintln(os.Stderr, "Error sending work:", err)
-                    continue
-                }
+    dispatcher:=new_dispatcher(client, work.Work, *workers, scheduler)
+    dispatcher.resume(state)
+    for !dispatcher.done(){
+        if len(hosts)==0 || time.Now().After(last_host_update_time.Add(5*time.Minute)){
+            hosts=find_servers()
+            last_host_update_time=time.Now()
+            log_info("Found hosts", "servers", strings.Join(hosts, ","))
+            watcher.set_hosts(hosts)
+        }
 
-                fmt.Println("Host", host, "accetpted")
+        accepted, err:=dispatcher.round(hosts)
+        run_state.save(dispatcher.tracked)
+        if err!=nil{
+            log_error("Aborting, servers do not accept our signatures", err)
+            os.Exit(1)
+        }
 
-                continue outer
-            }
+        if !accepted && !dispatcher.done(){
+            watcher.wait_at_most(dispatcher.next_retry(EVENTS_POLL_INTERVAL))
+        }
+    }
+    dispatcher.report()
 
-            time.Sleep(10*time.Second)
+    if *wait{
+        tracked_jobs:=wait_for_jobs(client, watcher, run_state, dispatcher.tracked, *workers)
+        scheduler.learn(tracked_jobs)
+        if print_report(tracked_jobs, dispatcher.unsatisfiable, dispatcher.rejected, dispatcher.skipped){
+            os.Exit(1)
         }
     }
 }
\ No newline at end of file
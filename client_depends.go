@@ -0,0 +1,209 @@
+package main;
+
+import "strings"
+import "fmt"
+
+// Outcome of entries that never ran because something they depend on did not succeed.
+const JOB_OUTCOME_SKIPPED = "skipped"
+
+type UnknownDependency struct{
+    work_path string
+    dependency string
+}
+
+func (u UnknownDependency) Error() string{
+    return fmt.Sprintf("UnknownDependency(%s depends on %s)", u.work_path, u.dependency)
+}
+
+type AmbiguousDependency struct{
+    dependency string
+}
+
+func (a AmbiguousDependency) Error() string{
+    return fmt.Sprintf("AmbiguousDependency(%s is in the work file more than once)", a.dependency)
+}
+
+type InvalidInput struct{
+    work_path string
+    input string
+    reason string
+}
+
+func (i InvalidInput) Error() string{
+    return fmt.Sprintf("InvalidInput(%s takes inputs from %s)(%s)", i.work_path, i.input, i.reason)
+}
+
+type DependencyCycle struct{
+    work_paths []string
+}
+
+func (d DependencyCycle) Error() string{
+    return fmt.Sprintf("DependencyCycle(%s)", strings.Join(d.work_paths, " -> "))
+}
+
+// Entries depend on other entries by their dir. Every dependency has to be in the work file exactly once,
+// and following them must never lead back to where it started. Inputs come from dependencies with outputs.
+func check_dependencies(work []WorkEntry) error{
+    entries:=make(map[string]int)
+    for i,entry:=range work{
+        if _, ok:=entries[entry.Dir]; ok{
+            entries[entry.Dir]=-1
+            continue
+        }
+        entries[entry.Dir]=i
+    }
+
+    for _,entry:=range work{
+        for _,dependency:=range entry.Depends_on{
+            i, ok:=entries[dependency]
+            if !ok{
+                return UnknownDependency{work_path: entry.Dir, dependency: dependency}
+            }
+            if i<0{
+                return AmbiguousDependency{dependency: dependency}
+            }
+        }
+
+        for _,input:=range entry.Inputs_from{
+            is_dependency:=false
+            for _,dependency:=range entry.Depends_on{
+                if dependency==input{
+                    is_dependency=true
+                }
+            }
+            if !is_dependency{
+                return InvalidInput{work_path: entry.Dir, input: input, reason: "not in depends_on"}
+            }
+            if len(work[entries[input]].Outputs)==0{
+                return InvalidInput{work_path: entry.Dir, input: input, reason: "it has no outputs"}
+            }
+        }
+    }
+
+    // Depth first, an entry that is reached again while it is still on the path closes a cycle.
+    const UNVISITED, ON_PATH, VISITED = 0, 1, 2
+    visits:=make([]int, len(work))
+    path:=make([]string, 0, len(work))
+    var visit func(i int) error
+    visit=func(i int) error{
+        visits[i]=ON_PATH
+        path=append(path, work[i].Dir)
+        for _,dependency:=range work[i].Depends_on{
+            j:=entries[dependency]
+            switch visits[j]{
+            case ON_PATH:
+                start:=0
+                for path[start]!=dependency{
+                    start++
+                }
+                return DependencyCycle{work_paths: append(append([]string{}, path[start:]...), dependency)}
+            case UNVISITED:
+                err:=visit(j)
+                if err!=nil{
+                    return err
+                }
+            }
+        }
+        path=path[:len(path)-1]
+        visits[i]=VISITED
+        return nil
+    }
+
+    for i:=range work{
+        if visits[i]==UNVISITED{
+            err:=visit(i)
+            if err!=nil{
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// Work paths others depend on, their jobs are followed so the dispatcher knows when the dependents may go.
+func depended_on(work []WorkEntry) map[string]bool{
+    needed:=make(map[string]bool)
+    for _,entry:=range work{
+        for _,dependency:=range entry.Depends_on{
+            needed[dependency]=true
+        }
+    }
+    return needed
+}
+
+// Work paths whose latest attempt succeeded, and those that will not: they failed without a retry to come,
+// could not be followed, or never ran at all.
+func (d *Dispatcher) dependency_outcomes() (map[string]bool, map[string]bool){
+    succeeded:=make(map[string]bool)
+    failed:=make(map[string]bool)
+    for _,tracked_job:=range d.tracked{
+        switch{
+        case tracked_job.outcome==JOB_OUTCOME_SUCCEEDED:
+            succeeded[tracked_job.entry.Dir]=true
+        case tracked_job.done() && !tracked_job.retried:
+            failed[tracked_job.entry.Dir]=true
+        }
+    }
+
+    for _,work_paths:=range [][]string{d.unsatisfiable, d.rejected, d.skipped}{
+        for _,work_path:=range work_paths{
+            failed[work_path]=true
+        }
+    }
+    return succeeded, failed
+}
+
+// The entry's command, with the jobs its inputs come from. Only called once all dependencies succeeded.
+func (d *Dispatcher) command(entry WorkEntry) Command{
+    command:=entry.command()
+    if len(entry.Inputs_from)==0{
+        return command
+    }
+
+    command.Inputs=append([]ArtifactSource{}, command.Inputs...)
+    for _,input:=range entry.Inputs_from{
+        for _,tracked_job:=range d.tracked{
+            if tracked_job.entry.Dir==input && tracked_job.outcome==JOB_OUTCOME_SUCCEEDED{
+                command.Inputs=append(command.Inputs, ArtifactSource{Host: tracked_job.host, Job: tracked_job.job, Token: tracked_job.artifact_token})
+                break
+            }
+        }
+    }
+    return command
+}
+
+func (d *Dispatcher) dependencies_succeeded(entry WorkEntry, succeeded map[string]bool) bool{
+    for _,dependency:=range entry.Depends_on{
+        if !succeeded[dependency]{
+            return false
+        }
+    }
+    return true
+}
+
+// Takes pending entries out for good once something they depend on failed, and so on down the graph.
+func (d *Dispatcher) skip_dependents(){
+    _, failed:=d.dependency_outcomes()
+    for skipped_any:=true; skipped_any;{
+        skipped_any=false
+        still_pending:=make([]PendingWork, 0, len(d.pending))
+        for _,work:=range d.pending{
+            failed_dependency:=""
+            for _,dependency:=range work.entry.Depends_on{
+                if failed[dependency]{
+                    failed_dependency=dependency
+                }
+            }
+
+            if len(failed_dependency)==0{
+                still_pending=append(still_pending, work)
+                continue
+            }
+            log_error("Skipping work, a dependency did not succeed", nil, "work_path", work.entry.Dir, "dependency", failed_dependency)
+            d.skipped=append(d.skipped, work.entry.Dir)
+            failed[work.entry.Dir]=true
+            skipped_any=true
+        }
+        d.pending=still_pending
+    }
+}
@@ -0,0 +1,411 @@
+package main;
+
+import "strings"
+import "sort"
+import "sync"
+import "time"
+
+const DEFAULT_WORKERS = 8
+
+// Runs the tasks with at most workers of them at a time and returns when all are done.
+func run_pool(workers int, tasks []func()){
+    if workers<1{
+        workers=1
+    }
+
+    semaphore:=make(chan bool, workers)
+    var wait_group sync.WaitGroup
+    for _,task:=range tasks{
+        wait_group.Add(1)
+        semaphore<-true
+        go func(task func()){
+            defer wait_group.Done()
+            defer func(){ <-semaphore }()
+            task()
+        }(task)
+    }
+    wait_group.Wait()
+}
+
+// What the client last heard from each host. Hosts that are down or incompatible are not in it.
+// hosts are the ones that answered the last refresh, known keeps the last answer of every listed host.
+type HostTable struct{
+    mutex *sync.Mutex
+    hosts map[string]RankedHost
+    known map[string]RankedHost
+}
+
+func new_host_table() HostTable{
+    return HostTable{mutex: &sync.Mutex{}, hosts: make(map[string]RankedHost), known: make(map[string]RankedHost)}
+}
+
+// Asks all hosts at once, so a few dead hosts cost one timeout rather than one each.
+func (t HostTable) refresh(client MyClient, hosts []string, workers int){
+    tasks:=make([]func(), 0, len(hosts))
+    for _,host:=range hosts{
+        tasks=append(tasks, func(host string) func(){
+            return func(){
+                ranked_host, err:=client.query_host(host)
+
+                t.mutex.Lock()
+                defer t.mutex.Unlock()
+                if err!=nil{
+                    log_error("Error checking health", err, "server", host)
+                    delete(t.hosts, host)
+                    return
+                }
+                t.hosts[host]=ranked_host
+                t.known[host]=ranked_host
+            }
+        }(host))
+    }
+    run_pool(workers, tasks)
+
+    listed:=make(map[string]bool)
+    for _,host:=range hosts{
+        listed[host]=true
+    }
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    for host:=range t.hosts{
+        if !listed[host]{
+            delete(t.hosts, host)
+        }
+    }
+    for host:=range t.known{
+        if !listed[host]{
+            delete(t.known, host)
+        }
+    }
+}
+
+// The last answer of every listed host, answered this round or not. all_known is false while a listed host
+// never answered, any entry could still turn out to fit it.
+func (t HostTable) last_known(hosts []string) ([]RankedHost, bool){
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    known_hosts:=make([]RankedHost, 0, len(hosts))
+    all_known:=true
+    for _,host:=range hosts{
+        ranked_host, ok:=t.known[host]
+        if !ok{
+            all_known=false
+            continue
+        }
+        known_hosts=append(known_hosts, ranked_host)
+    }
+    return known_hosts, all_known
+}
+
+func (t HostTable) ranked(hosts []string) []RankedHost{
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    ranked_hosts:=make([]RankedHost, 0, len(hosts))
+    for _,host:=range hosts{
+        ranked_host, ok:=t.hosts[host]
+        if ok{
+            ranked_hosts=append(ranked_hosts, ranked_host)
+        }
+    }
+    return ranked_hosts
+}
+
+// Hosts without info can not say how many slots are free, they get one entry per round.
+func has_free_slot(ranked_host RankedHost, planned int) bool{
+    if !ranked_host.has_info{
+        return planned==0
+    }
+    return !ranked_host.info.Busy && ranked_host.info.Slots-ranked_host.info.Slots_used-planned>0
+}
+
+func add_resources(a JobResources, b JobResources) JobResources{
+    return JobResources{Cpus: a.Cpus+b.Cpus, Memory_bytes: a.Memory_bytes+b.Memory_bytes, Disk_bytes: a.Disk_bytes+b.Disk_bytes}
+}
+
+
+
+
+type Assignment struct{
+    work PendingWork
+    ranked_host RankedHost
+    work_message WorkMessage
+    err error
+}
+
+// Job is empty for servers that do not say which job they started.
+type DispatchedJob struct{
+    entry WorkEntry
+    host string
+    health HealthMessage
+    job string
+    artifact_token string
+    attempt int
+    failed_hosts map[string]bool
+}
+
+// An entry waiting for a host. Retries wait until not_before and keep clear of the hosts they failed on, hosts
+// that refused it for good are not asked again. unsatisfiable_rounds counts the rounds in a row no known host
+// could run it.
+type PendingWork struct{
+    entry WorkEntry
+    attempt int
+    not_before time.Time
+    failed_hosts map[string]bool
+    refused_hosts map[string]bool
+    unsatisfiable_rounds int
+}
+
+// While some listed host never answered, an entry no other host can run is given up on after this many rounds.
+const UNSATISFIABLE_ROUNDS = 3
+
+// Hands out the pending work in rounds. Each round plans every entry onto a host with a free slot, in the order
+// the scheduler puts work and hosts in, then submits to all of those hosts at once. Entries that find no free
+// host wait for the next round.
+// Jobs with a retry policy or dependents are followed until they finish. Failed ones go back to pending if
+// they may be retried, entries wait until everything they depend on succeeded.
+// A host that had too many leases from our address gets only as many entries next round as it took this one.
+type Dispatcher struct{
+    client MyClient
+    table HostTable
+    workers int
+    scheduler Scheduler
+    needed map[string]bool
+    pending []PendingWork
+    tracked []*TrackedJob
+    unsatisfiable []string
+    rejected []string
+    skipped []string
+    lease_limits map[string]int
+}
+
+func new_dispatcher(client MyClient, work []WorkEntry, workers int, scheduler Scheduler) *Dispatcher{
+    pending:=make([]PendingWork, 0, len(work))
+    for _,entry:=range work{
+        pending=append(pending, PendingWork{entry: entry, attempt: 1})
+    }
+    return &Dispatcher{client: client, table: new_host_table(), workers: workers, scheduler: scheduler, needed: depended_on(work), pending: pending}
+}
+
+func (d *Dispatcher) follows(entry WorkEntry) bool{
+    return entry.Retry!=nil || d.needed[entry.Dir]
+}
+
+func (d *Dispatcher) done() bool{
+    if len(d.pending)!=0{
+        return false
+    }
+    for _,tracked_job:=range d.tracked{
+        if d.follows(tracked_job.entry) && !tracked_job.done(){
+            return false
+        }
+    }
+    return true
+}
+
+// How long until the next retry may go out, at most limit.
+func (d *Dispatcher) next_retry(limit time.Duration) time.Duration{
+    now:=time.Now()
+    for _,work:=range d.pending{
+        if work.not_before.After(now) && work.not_before.Sub(now)<limit{
+            limit=work.not_before.Sub(now)
+        }
+    }
+    return limit
+}
+
+// Higher priority first, then higher weight. Negative when a goes before b, 0 when neither goes first.
+func compare_pending(a PendingWork, b PendingWork) int{
+    switch{
+    case a.entry.Priority>b.entry.Priority:
+        return -1
+    case a.entry.Priority<b.entry.Priority:
+        return 1
+    case a.entry.Weight>b.entry.Weight:
+        return -1
+    case a.entry.Weight<b.entry.Weight:
+        return 1
+    }
+    return 0
+}
+
+// Without priorities or weights this keeps the work file order, retries go after what was already pending.
+func sort_pending(pending []PendingWork){
+    sort.SliceStable(pending, func(i, j int) bool{
+        return compare_pending(pending[i], pending[j])<0
+    })
+}
+
+// Plans against a copy of the table, counting each planned entry against its host so the same free slot or
+// resources are not handed out twice.
+func (d *Dispatcher) plan(ranked_hosts []RankedHost) []*Assignment{
+    planned:=make(map[string]int)
+    assignments:=make([]*Assignment, len(d.pending))
+    succeeded, _:=d.dependency_outcomes()
+    now:=time.Now()
+    for i,work:=range d.pending{
+        if now.Before(work.not_before) || !d.dependencies_succeeded(work.entry, succeeded){
+            continue
+        }
+
+        entry:=work.entry
+        candidates:=candidate_hosts(d.scheduler.order_hosts(entry, without_refused_hosts(ranked_hosts, work.refused_hosts)), entry, d.follows(entry))
+        for _,candidate:=range avoid_failed_hosts(candidates, work.failed_hosts){
+            if !has_free_slot(candidate, planned[candidate.host]){
+                continue
+            }
+            if limit, ok:=d.lease_limits[candidate.host]; ok && planned[candidate.host]>=limit{
+                continue
+            }
+
+            planned[candidate.host]++
+            if entry.Resources!=nil{
+                for j:=range ranked_hosts{
+                    if ranked_hosts[j].host==candidate.host{
+                        ranked_hosts[j].info.Reserved=add_resources(ranked_hosts[j].info.Reserved, *entry.Resources)
+                    }
+                }
+            }
+            assignments[i]=&Assignment{work: work, ranked_host: candidate}
+            break
+        }
+    }
+    return assignments
+}
+
+// Polls the jobs that are followed and puts the failed ones that may be retried back into pending.
+func (d *Dispatcher) check_jobs(){
+    tasks:=make([]func(), 0)
+    for _,tracked_job:=range d.tracked{
+        if d.follows(tracked_job.entry) && !tracked_job.done(){
+            tasks=append(tasks, func(tracked_job *TrackedJob) func(){
+                return func(){ tracked_job.poll(d.client) }
+            }(tracked_job))
+        }
+    }
+    run_pool(d.workers, tasks)
+
+    for _,tracked_job:=range d.tracked{
+        if !tracked_job.done() || tracked_job.retried || !tracked_job.entry.Retry.should_retry(tracked_job.attempt, tracked_job.outcome, tracked_job.status.Exit_code){
+            continue
+        }
+
+        tracked_job.retried=true
+        failed_hosts:=map[string]bool{tracked_job.host: true}
+        for host:=range tracked_job.failed_hosts{
+            failed_hosts[host]=true
+        }
+        backoff:=tracked_job.entry.Retry.backoff(tracked_job.attempt)
+        log_warning("Retrying job", "server", tracked_job.host, "work_path", tracked_job.entry.Dir, "job", tracked_job.job, "reason", tracked_job.outcome, "attempt", tracked_job.attempt+1, "backoff", backoff)
+        d.pending=append(d.pending, PendingWork{entry: tracked_job.entry, attempt: tracked_job.attempt+1, not_before: time.Now().Add(backoff), failed_hosts: failed_hosts})
+    }
+}
+
+// Returns whether any work was accepted. The error is set when a server did not accept our signature,
+// then there is no point in going on, but the work other hosts accepted this round is still tracked.
+func (d *Dispatcher) round(hosts []string) (bool, error){
+    d.check_jobs()
+    d.scheduler.learn(d.tracked)
+    d.table.refresh(d.client, hosts, d.workers)
+    ranked_hosts:=d.table.ranked(hosts)
+
+    // A matching host that missed this refresh is only unreachable for now, so its last answer counts.
+    known_hosts, all_known:=d.table.last_known(hosts)
+    satisfiable:=make([]PendingWork, 0, len(d.pending))
+    for _,work:=range d.pending{
+        hosts_left:=without_refused_hosts(known_hosts, work.refused_hosts)
+        if is_satisfiable(hosts_left, work.entry, d.follows(work.entry)) && (len(hosts_left)!=0 || len(known_hosts)==0){
+            work.unsatisfiable_rounds=0
+        } else{
+            work.unsatisfiable_rounds++
+        }
+        if work.unsatisfiable_rounds>0 && (all_known || work.unsatisfiable_rounds>=UNSATISFIABLE_ROUNDS){
+            if len(work.refused_hosts)!=0{
+                log_error("Every host that could run the work refused it", nil, "work_path", work.entry.Dir)
+                d.rejected=append(d.rejected, work.entry.Dir)
+                continue
+            }
+            log_error("No host can satisfy the requirements or resources", nil, "work_path", work.entry.Dir)
+            d.unsatisfiable=append(d.unsatisfiable, work.entry.Dir)
+            continue
+        }
+        satisfiable=append(satisfiable, work)
+    }
+    d.pending=satisfiable
+    d.skip_dependents()
+    d.scheduler.order_work(d.pending)
+
+    assignments:=d.plan(ranked_hosts)
+    tasks:=make([]func(), 0, len(assignments))
+    for _,assignment:=range assignments{
+        if assignment!=nil{
+            tasks=append(tasks, func(assignment *Assignment) func(){
+                return func(){
+                    assignment.work_message, assignment.err=d.client.try_host(assignment.ranked_host, d.command(assignment.work.entry))
+                }
+            }(assignment))
+        }
+    }
+    run_pool(d.workers, tasks)
+
+    accepted:=false
+    var unauthorized error
+    accepted_by:=make(map[string]int)
+    lease_limits:=make(map[string]int)
+    still_pending:=make([]PendingWork, 0, len(d.pending))
+    for i,work:=range d.pending{
+        assignment:=assignments[i]
+        entry:=work.entry
+        switch{
+        case assignment==nil:
+            still_pending=append(still_pending, work)
+        case assignment.err==nil:
+            log_info("Host accepted", "server", assignment.ranked_host.host, "work_path", entry.Dir, "job", assignment.work_message.Job, "attempt", work.attempt)
+            d.tracked=append(d.tracked, &TrackedJob{DispatchedJob: DispatchedJob{entry: entry, host: assignment.ranked_host.host, health: assignment.ranked_host.health, job: assignment.work_message.Job, artifact_token: assignment.work_message.Artifact_token, attempt: work.attempt, failed_hosts: work.failed_hosts}})
+            accepted_by[assignment.ranked_host.host]++
+            accepted=true
+        case error_code(assignment.err)==ERROR_UNAUTHORIZED:
+            unauthorized=assignment.err
+            still_pending=append(still_pending, work)
+        case error_code(assignment.err)==ERROR_TOO_MANY_LEASES:
+            lease_limits[assignment.ranked_host.host]=0
+            still_pending=append(still_pending, work)
+        case is_final_error(assignment.err):
+            log_error("Work was rejected", assignment.err, "work_path", entry.Dir)
+            d.rejected=append(d.rejected, entry.Dir)
+        case !is_retryable(assignment.err):
+            log_error("Host refused the work for good", assignment.err, "server", assignment.ranked_host.host, "work_path", entry.Dir)
+            refused_hosts:=map[string]bool{assignment.ranked_host.host: true}
+            for host:=range work.refused_hosts{
+                refused_hosts[host]=true
+            }
+            work.refused_hosts=refused_hosts
+            still_pending=append(still_pending, work)
+        default:
+            still_pending=append(still_pending, work)
+        }
+    }
+    d.pending=still_pending
+
+    for host:=range lease_limits{
+        lease_limits[host]=max(accepted_by[host], 1)
+    }
+    d.lease_limits=lease_limits
+    return accepted, unauthorized
+}
+
+func (d *Dispatcher) report(){
+    if len(d.unsatisfiable)!=0{
+        log_error("Work no host could run", nil, "work_paths", strings.Join(d.unsatisfiable, ","))
+    }
+
+    if len(d.rejected)!=0{
+        log_error("Work that was rejected", nil, "work_paths", strings.Join(d.rejected, ","))
+    }
+
+    if len(d.skipped)!=0{
+        log_error("Work skipped after a dependency failed", nil, "work_paths", strings.Join(d.skipped, ","))
+    }
+}
@@ -0,0 +1,166 @@
+package main;
+
+import "encoding/json"
+import "net/http"
+import "strings"
+import "context"
+import "bufio"
+import "sync"
+import "time"
+import "fmt"
+
+const EVENT_RECONNECT_DELAY = 5*time.Second
+
+// Hosts without events are polled as often as before. When every host streams events, polling only
+// covers events that got lost.
+const POLL_INTERVAL = 10*time.Second
+const EVENTS_POLL_INTERVAL = 60*time.Second
+
+// Follows the event streams of all hosts that have one and wakes the dispatch loop up when any of them frees a
+// slot or finishes a job. Hosts without events are only picked up again when wait times out.
+type EventWatcher struct{
+    client *http.Client
+    health_client MyClient
+    wake chan string
+    mutex *sync.Mutex
+    watching map[string]context.CancelFunc
+    streaming map[string]bool
+}
+
+// The stream stays open for as long as the host is up, so its client must not time out like the others.
+func new_event_watcher(health_client MyClient) EventWatcher{
+    return EventWatcher{
+        client: &http.Client{},
+        health_client: health_client,
+        wake: make(chan string, 1),
+        mutex: &sync.Mutex{},
+        watching: make(map[string]context.CancelFunc),
+        streaming: make(map[string]bool),
+    }
+}
+
+// Starts following hosts that are new and stops following those that are gone.
+func (e EventWatcher) set_hosts(hosts []string){
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+
+    wanted:=make(map[string]bool)
+    for _,host:=range hosts{
+        wanted[host]=true
+        if _, ok:=e.watching[host]; !ok{
+            ctx, cancel:=context.WithCancel(context.Background())
+            e.watching[host]=cancel
+            go e.follow(ctx, host)
+        }
+    }
+
+    for host, cancel:=range e.watching{
+        if !wanted[host]{
+            cancel()
+            delete(e.watching, host)
+            delete(e.streaming, host)
+        }
+    }
+}
+
+func (e EventWatcher) set_streaming(host string, streaming bool){
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    if _, ok:=e.watching[host]; ok{
+        e.streaming[host]=streaming
+    }
+}
+
+func (e EventWatcher) poll_interval() time.Duration{
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    for host:=range e.watching{
+        if !e.streaming[host]{
+            return POLL_INTERVAL
+        }
+    }
+    return EVENTS_POLL_INTERVAL
+}
+
+// Returns the host that freed a slot, or "" if nothing happened before it is time to poll again.
+func (e EventWatcher) wait() string{
+    return e.wait_at_most(e.poll_interval())
+}
+
+// Like wait, but returns after limit if that comes before the next poll, e.g. when a retry is due.
+func (e EventWatcher) wait_at_most(limit time.Duration) string{
+    timeout:=min(e.poll_interval(), limit)
+    select{
+    case host:=<-e.wake:
+        return host
+    case <-time.After(timeout):
+        return ""
+    }
+}
+
+// One wake up is enough however many events came in, the dispatch loop looks at all hosts anyway.
+func (e EventWatcher) notify(host string){
+    select{
+    case e.wake<-host:
+    default:
+    }
+}
+
+func (e EventWatcher) follow(ctx context.Context, host string){
+    for ctx.Err()==nil{
+        health, err:=e.health_client.get_health(host)
+        if err==nil && !health.supports(FEATURE_EVENTS){
+            return
+        }
+
+        if err==nil{
+            err=e.read_stream(ctx, host)
+        }
+        e.set_streaming(host, false)
+        if err!=nil && ctx.Err()==nil{
+            log_warning("Lost event stream, reconnecting", "server", host, "error", err)
+        }
+
+        select{
+        case <-ctx.Done():
+        case <-time.After(EVENT_RECONNECT_DELAY):
+        }
+    }
+}
+
+func (e EventWatcher) read_stream(ctx context.Context, host string) error{
+    request, err:=http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s:4753/api/v2/events", host), nil)
+    if err!=nil{
+        return err
+    }
+
+    response, err:=e.client.Do(request)
+    if err!=nil{
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode!=200{
+        return read_error(host, response)
+    }
+    e.set_streaming(host, true)
+
+    scanner:=bufio.NewScanner(response.Body)
+    for scanner.Scan(){
+        line:=scanner.Text()
+        if !strings.HasPrefix(line, "data: "){
+            continue
+        }
+
+        var event EventMessage
+        err=json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+        if err!=nil{
+            return err
+        }
+
+        if event.Type==EVENT_SLOT_FREED || event.Type==EVENT_JOB_FINISHED || (event.Type==EVENT_DRAIN && !event.Draining){
+            e.notify(host)
+        }
+    }
+    return scanner.Err()
+}
@@ -0,0 +1,158 @@
+package main;
+
+import "strconv"
+import "strings"
+import "fmt"
+
+// Longer operators first, so ">=" is not taken for ">".
+var CONSTRAINT_OPERATORS = []string{">=", "<=", "!=", "=", ">", "<"}
+
+type Constraint struct{
+    label string
+    operator string
+    value string
+}
+
+type InvalidConstraint struct{
+    constraint string
+}
+
+func (i InvalidConstraint) Error() string{
+    return fmt.Sprintf("InvalidConstraint(%s)", i.constraint)
+}
+
+func parse_constraint(constraint string) (Constraint, error){
+    for _,operator:=range CONSTRAINT_OPERATORS{
+        i:=strings.Index(constraint, operator)
+        if i<0{
+            continue
+        }
+
+        label:=strings.TrimSpace(constraint[:i])
+        value:=strings.TrimSpace(constraint[i+len(operator):])
+        if len(label)==0 || len(value)==0{
+            return Constraint{}, InvalidConstraint{constraint: constraint}
+        }
+
+        _, numeric:=parse_quantity(value)
+        if operator!="=" && operator!="!=" && !numeric{
+            return Constraint{}, InvalidConstraint{constraint: constraint}
+        }
+
+        return Constraint{label: label, operator: operator, value: value}, nil
+    }
+
+    return Constraint{}, InvalidConstraint{constraint: constraint}
+}
+
+// Parses numbers with an optional binary size suffix, so "32G" is 32*1024^3. The "mem" label is rounded up to
+// whole GiB, see memory_label, so "mem>=32G" matches a machine with 32G installed.
+func parse_quantity(value string) (float64, bool){
+    multiplier:=1.0
+    if len(value)!=0{
+        switch value[len(value)-1]{
+        case 'K', 'k':
+            multiplier=1<<10
+        case 'M', 'm':
+            multiplier=1<<20
+        case 'G', 'g':
+            multiplier=1<<30
+        case 'T', 't':
+            multiplier=1<<40
+        }
+    }
+    if multiplier!=1{
+        value=value[:len(value)-1]
+    }
+
+    number, err:=strconv.ParseFloat(value, 64)
+    if err!=nil{
+        return 0, false
+    }
+    return number*multiplier, true
+}
+
+// Values are compared as quantities when both sides are numbers, otherwise as strings.
+func (c Constraint) matches(labels map[string]string) bool{
+    label_value, ok:=labels[c.label]
+    if !ok{
+        return false
+    }
+
+    have, have_numeric:=parse_quantity(label_value)
+    want, want_numeric:=parse_quantity(c.value)
+    if !have_numeric || !want_numeric{
+        switch c.operator{
+        case "=":
+            return label_value==c.value
+        case "!=":
+            return label_value!=c.value
+        }
+        return false
+    }
+
+    switch c.operator{
+    case "=":
+        return have==want
+    case "!=":
+        return have!=want
+    case ">=":
+        return have>=want
+    case "<=":
+        return have<=want
+    case ">":
+        return have>want
+    case "<":
+        return have<want
+    }
+    return false
+}
+
+func parse_constraints(constraints []string) ([]Constraint, error){
+    parsed:=make([]Constraint, 0, len(constraints))
+    for _,constraint:=range constraints{
+        c, err:=parse_constraint(constraint)
+        if err!=nil{
+            return nil, err
+        }
+        parsed=append(parsed, c)
+    }
+    return parsed, nil
+}
+
+// The kernel keeps some memory for itself, so MemTotal is a little less than what is installed. Rounding it up
+// to whole GiB gets back the installed amount.
+func memory_label(memory_total_bytes uint64) string{
+    return strconv.FormatUint((memory_total_bytes+(1<<30)-1)>>30<<30, 10)
+}
+
+// The server's configured labels, plus "cpus", "mem" and "disk" taken from its info unless configured otherwise.
+func (r RankedHost) labels() map[string]string{
+    labels:=map[string]string{
+        "cpus": strconv.Itoa(r.info.Cpus),
+        "mem": memory_label(r.info.Memory_total_bytes),
+        "disk": strconv.FormatUint(r.info.Disk_free_bytes, 10),
+    }
+    for label,value:=range r.info.Labels{
+        labels[label]=value
+    }
+    return labels
+}
+
+// Hosts that did not send their info can only run work without requirements.
+func (r RankedHost) satisfies(constraints []Constraint) bool{
+    if len(constraints)==0{
+        return true
+    }
+    if !r.has_info{
+        return false
+    }
+
+    labels:=r.labels()
+    for _,constraint:=range constraints{
+        if !constraint.matches(labels){
+            return false
+        }
+    }
+    return true
+}
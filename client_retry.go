@@ -0,0 +1,128 @@
+package main;
+
+import "math"
+import "time"
+import "fmt"
+
+// Max_attempts counts the first attempt, so 1 means no retries. The wait before retry n is
+// Backoff_seconds*Backoff_factor^(n-1), at most Max_backoff_seconds. An attempt is retried if its outcome is in
+// Retry_outcomes and, for failed jobs, its exit code is in Retry_exit_codes. Empty lists mean the defaults below
+// and any exit code.
+type RetryPolicy struct{
+    Max_attempts int `json:"max_attempts"`
+    Backoff_seconds float64 `json:"backoff_seconds"`
+    Backoff_factor float64 `json:"backoff_factor"`
+    Max_backoff_seconds float64 `json:"max_backoff_seconds"`
+    Retry_exit_codes []int `json:"retry_exit_codes"`
+    Retry_outcomes []string `json:"retry_outcomes"`
+}
+
+var DEFAULT_RETRY_OUTCOMES = []string{JOB_OUTCOME_FAILED, JOB_OUTCOME_OOM_KILLED, JOB_OUTCOME_LOST}
+
+type InvalidRetryPolicy struct{
+    reason string
+}
+
+func (i InvalidRetryPolicy) Error() string{
+    return fmt.Sprintf("InvalidRetryPolicy(%s)", i.reason)
+}
+
+// Fills in defaults and checks the policy, a nil policy stays nil.
+func (r *RetryPolicy) validate() error{
+    if r==nil{
+        return nil
+    }
+
+    if r.Max_attempts<0 || r.Backoff_seconds<0 || r.Backoff_factor<0 || r.Max_backoff_seconds<0{
+        return InvalidRetryPolicy{reason: "values must not be negative"}
+    }
+    if r.Max_attempts==0{
+        r.Max_attempts=1
+    }
+    if r.Backoff_seconds==0{
+        r.Backoff_seconds=10
+    }
+    if r.Backoff_factor==0{
+        r.Backoff_factor=2
+    }
+    if r.Max_backoff_seconds==0{
+        r.Max_backoff_seconds=600
+    }
+
+    if len(r.Retry_outcomes)==0{
+        r.Retry_outcomes=DEFAULT_RETRY_OUTCOMES
+    }
+    for _,outcome:=range r.Retry_outcomes{
+        switch outcome{
+        case JOB_OUTCOME_FAILED, JOB_OUTCOME_OOM_KILLED, JOB_OUTCOME_LOST:
+        default:
+            return InvalidRetryPolicy{reason: "unknown outcome "+outcome}
+        }
+    }
+    return nil
+}
+
+func (r *RetryPolicy) should_retry(attempt int, outcome string, exit_code *int) bool{
+    if r==nil || attempt>=r.Max_attempts{
+        return false
+    }
+
+    retryable:=false
+    for _,retry_outcome:=range r.Retry_outcomes{
+        if retry_outcome==outcome{
+            retryable=true
+        }
+    }
+    if !retryable || outcome!=JOB_OUTCOME_FAILED || len(r.Retry_exit_codes)==0{
+        return retryable
+    }
+
+    if exit_code==nil{
+        return false
+    }
+    for _,retry_exit_code:=range r.Retry_exit_codes{
+        if retry_exit_code==*exit_code{
+            return true
+        }
+    }
+    return false
+}
+
+// How long to wait before the attempt after the given one.
+func (r *RetryPolicy) backoff(attempt int) time.Duration{
+    seconds:=math.Min(r.Backoff_seconds*math.Pow(r.Backoff_factor, float64(attempt-1)), r.Max_backoff_seconds)
+    return time.Duration(seconds*float64(time.Second))
+}
+
+// Hosts that refused an entry for good, e.g. because they do not allow isolation, are not asked again.
+func without_refused_hosts(ranked_hosts []RankedHost, refused_hosts map[string]bool) []RankedHost{
+    if len(refused_hosts)==0{
+        return ranked_hosts
+    }
+
+    left:=make([]RankedHost, 0, len(ranked_hosts))
+    for _,ranked_host:=range ranked_hosts{
+        if !refused_hosts[ranked_host.host]{
+            left=append(left, ranked_host)
+        }
+    }
+    return left
+}
+
+// Hosts an earlier attempt failed on go last, so a retry lands elsewhere if any other host can take it.
+func avoid_failed_hosts(candidates []RankedHost, failed_hosts map[string]bool) []RankedHost{
+    if len(failed_hosts)==0{
+        return candidates
+    }
+
+    preferred:=make([]RankedHost, 0, len(candidates))
+    avoided:=make([]RankedHost, 0, len(candidates))
+    for _,candidate:=range candidates{
+        if failed_hosts[candidate.host]{
+            avoided=append(avoided, candidate)
+        } else{
+            preferred=append(preferred, candidate)
+        }
+    }
+    return append(preferred, avoided...)
+}
@@ -0,0 +1,270 @@
+package main;
+
+import "encoding/json"
+import "math/rand"
+import "sort"
+import "fmt"
+import "os"
+
+const SCHEDULER_LEAST_LOADED = "least_loaded"
+const SCHEDULER_LIST_ORDER = "list_order"
+const SCHEDULER_ROUND_ROBIN = "round_robin"
+const SCHEDULER_RANDOM = "random"
+const SCHEDULER_LONGEST_JOB_FIRST = "longest_job_first"
+const SCHEDULER_STICKY = "sticky"
+
+var SCHEDULERS = []string{SCHEDULER_LEAST_LOADED, SCHEDULER_LIST_ORDER, SCHEDULER_ROUND_ROBIN, SCHEDULER_RANDOM, SCHEDULER_LONGEST_JOB_FIRST, SCHEDULER_STICKY}
+
+// Decides which pending work goes first and which hosts it should go to. order_hosts gets the hosts in the order
+// of the host list and returns a new slice, work with resource requests still goes where it fits best.
+// learn sees every job dispatched so far after each round and once more after waiting for them.
+type Scheduler interface{
+    order_work(pending []PendingWork)
+    order_hosts(entry WorkEntry, ranked_hosts []RankedHost) []RankedHost
+    learn(tracked_jobs []*TrackedJob)
+}
+
+type UnknownScheduler struct{
+    name string
+}
+
+func (u UnknownScheduler) Error() string{
+    return fmt.Sprintf("UnknownScheduler(%s)", u.name)
+}
+
+func new_scheduler(name string, history_path string) (Scheduler, error){
+    switch name{
+    case SCHEDULER_LEAST_LOADED:
+        return LeastLoaded{}, nil
+    case SCHEDULER_LIST_ORDER:
+        return ListOrder{}, nil
+    case SCHEDULER_ROUND_ROBIN:
+        return &RoundRobin{}, nil
+    case SCHEDULER_RANDOM:
+        return Random{}, nil
+    case SCHEDULER_LONGEST_JOB_FIRST, SCHEDULER_STICKY:
+        history, err:=load_scheduler_history(history_path)
+        if err!=nil{
+            return nil, err
+        }
+        if name==SCHEDULER_STICKY{
+            return Sticky{history: history}, nil
+        }
+        return LongestJobFirst{history: history}, nil
+    }
+    return nil, UnknownScheduler{name: name}
+}
+
+func copy_hosts(ranked_hosts []RankedHost) []RankedHost{
+    return append(make([]RankedHost, 0, len(ranked_hosts)), ranked_hosts...)
+}
+
+
+
+
+// What the client learnt about each work path in earlier runs: how long it took the last time it succeeded and
+// which host ran it last. Only jobs the client followed to the end have a duration.
+type SchedulerHistory struct{
+    path string
+    Durations map[string]float64 `json:"durations"`
+    Hosts map[string]string `json:"hosts"`
+}
+
+func load_scheduler_history(path string) (*SchedulerHistory, error){
+    history:=&SchedulerHistory{path: path, Durations: make(map[string]float64), Hosts: make(map[string]string)}
+    f, err:=os.Open(path)
+    if os.IsNotExist(err){
+        return history, nil
+    }
+    if err!=nil{
+        return nil, err
+    }
+    defer f.Close()
+
+    err=json.NewDecoder(f).Decode(history)
+    if err!=nil{
+        return nil, err
+    }
+    if history.Durations==nil{
+        history.Durations=make(map[string]float64)
+    }
+    if history.Hosts==nil{
+        history.Hosts=make(map[string]string)
+    }
+    return history, nil
+}
+
+// Later jobs overwrite earlier ones, the file is only written when something changed.
+func (h *SchedulerHistory) learn(tracked_jobs []*TrackedJob){
+    changed:=false
+    for _,tracked_job:=range tracked_jobs{
+        work_path:=tracked_job.entry.Dir
+        if tracked_job.done() && tracked_job.outcome!=JOB_OUTCOME_SUCCEEDED && tracked_job.outcome!=JOB_OUTCOME_UNTRACKED{
+            continue
+        }
+
+        if h.Hosts[work_path]!=tracked_job.host{
+            h.Hosts[work_path]=tracked_job.host
+            changed=true
+        }
+        duration:=tracked_job.status.Duration_seconds
+        if tracked_job.outcome==JOB_OUTCOME_SUCCEEDED && duration>0 && h.Durations[work_path]!=duration{
+            h.Durations[work_path]=duration
+            changed=true
+        }
+    }
+
+    if changed{
+        h.save()
+    }
+}
+
+func (h *SchedulerHistory) save(){
+    history_in_bytes, err:=json.MarshalIndent(h, "", "    ")
+    if err!=nil{
+        log_error("Error encoding scheduler history", err)
+        return
+    }
+
+    temporary_path:=h.path+".tmp"
+    err=os.WriteFile(temporary_path, history_in_bytes, 0600)
+    if err==nil{
+        err=os.Rename(temporary_path, h.path)
+    }
+    if err!=nil{
+        log_error("Error saving scheduler history", err, "path", h.path)
+    }
+}
+
+
+
+
+// The default: work by priority, hosts least loaded first.
+type LeastLoaded struct{}
+
+func (LeastLoaded) order_work(pending []PendingWork){
+    sort_pending(pending)
+}
+
+func (LeastLoaded) order_hosts(entry WorkEntry, ranked_hosts []RankedHost) []RankedHost{
+    ordered:=copy_hosts(ranked_hosts)
+    sort_ranked_hosts(ordered)
+    return ordered
+}
+
+func (LeastLoaded) learn(tracked_jobs []*TrackedJob){}
+
+// The first host in the host list that has a free slot.
+type ListOrder struct{}
+
+func (ListOrder) order_work(pending []PendingWork){
+    sort_pending(pending)
+}
+
+func (ListOrder) order_hosts(entry WorkEntry, ranked_hosts []RankedHost) []RankedHost{
+    return copy_hosts(ranked_hosts)
+}
+
+func (ListOrder) learn(tracked_jobs []*TrackedJob){}
+
+// Each entry starts one host further down the host list than the one before.
+type RoundRobin struct{
+    next int
+}
+
+func (r *RoundRobin) order_work(pending []PendingWork){
+    sort_pending(pending)
+}
+
+func (r *RoundRobin) order_hosts(entry WorkEntry, ranked_hosts []RankedHost) []RankedHost{
+    if len(ranked_hosts)==0{
+        return nil
+    }
+
+    start:=r.next%len(ranked_hosts)
+    r.next++
+    return append(copy_hosts(ranked_hosts[start:]), ranked_hosts[:start]...)
+}
+
+func (r *RoundRobin) learn(tracked_jobs []*TrackedJob){}
+
+type Random struct{}
+
+func (Random) order_work(pending []PendingWork){
+    sort_pending(pending)
+}
+
+func (Random) order_hosts(entry WorkEntry, ranked_hosts []RankedHost) []RankedHost{
+    ordered:=copy_hosts(ranked_hosts)
+    rand.Shuffle(len(ordered), func(i, j int){
+        ordered[i], ordered[j]=ordered[j], ordered[i]
+    })
+    return ordered
+}
+
+func (Random) learn(tracked_jobs []*TrackedJob){}
+
+// Work goes by priority and weight like everywhere else, among equals the work that took longest last time goes
+// first, so it does not hold up the end of the run. Work that never finished before counts as taking as long as
+// the average. Hosts are least loaded first.
+type LongestJobFirst struct{
+    history *SchedulerHistory
+}
+
+func (l LongestJobFirst) order_work(pending []PendingWork){
+    average:=0.0
+    for _,duration:=range l.history.Durations{
+        average+=duration/float64(len(l.history.Durations))
+    }
+
+    duration:=func(work PendingWork) float64{
+        duration, ok:=l.history.Durations[work.entry.Dir]
+        if !ok{
+            return average
+        }
+        return duration
+    }
+
+    sort.SliceStable(pending, func(i, j int) bool{
+        order:=compare_pending(pending[i], pending[j])
+        if order!=0{
+            return order<0
+        }
+        return duration(pending[i])>duration(pending[j])
+    })
+}
+
+func (l LongestJobFirst) order_hosts(entry WorkEntry, ranked_hosts []RankedHost) []RankedHost{
+    return LeastLoaded{}.order_hosts(entry, ranked_hosts)
+}
+
+func (l LongestJobFirst) learn(tracked_jobs []*TrackedJob){
+    l.history.learn(tracked_jobs)
+}
+
+// Work goes back to the host that ran it last, where its build tree and caches are still warm, if that host
+// has a free slot. Other hosts are least loaded first.
+type Sticky struct{
+    history *SchedulerHistory
+}
+
+func (s Sticky) order_work(pending []PendingWork){
+    sort_pending(pending)
+}
+
+func (s Sticky) order_hosts(entry WorkEntry, ranked_hosts []RankedHost) []RankedHost{
+    ordered:=LeastLoaded{}.order_hosts(entry, ranked_hosts)
+    last_host, ok:=s.history.Hosts[entry.Dir]
+    if !ok{
+        return ordered
+    }
+
+    sort.SliceStable(ordered, func(i, j int) bool{
+        return ordered[i].host==last_host && ordered[j].host!=last_host
+    })
+    return ordered
+}
+
+func (s Sticky) learn(tracked_jobs []*TrackedJob){
+    s.history.learn(tracked_jobs)
+}
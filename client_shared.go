@@ -0,0 +1,620 @@
+package main;
+
+import "encoding/binary"
+import "encoding/json"
+import "crypto/sha256"
+import "crypto/ecdsa"
+import "crypto/x509"
+import "crypto/rand"
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "bytes"
+import "sort"
+import "math"
+import "time"
+import "fmt"
+import "os"
+
+func load_private_key() (*ecdsa.PrivateKey, error){
+    key_in_bytes, err:=ioutil.ReadFile("private.key")
+    if err!=nil{
+        return nil, err
+    }
+
+    return x509.ParseECPrivateKey(key_in_bytes)
+}
+
+func read_list_file(filename string) ([]string, error){
+    content, err:=ioutil.ReadFile(filename)
+    if err!=nil{
+        return nil, err
+    }
+
+    lines:=strings.Split(string(content), "\n")
+    return_strings:=make([]string, 0, len(lines))
+    for _,line :=range lines{
+        trimmed_line:=strings.TrimSpace(line)
+        if len(trimmed_line)==0{
+            continue
+        }
+
+        return_strings=append(return_strings, trimmed_line)
+    }
+
+    return return_strings, nil
+}
+
+// Requires holds constraints on the host's labels, e.g. "toolchain=gcc12" or "mem>=32G".
+// Entries without a retry policy use the one of the work file, if any. Depends_on lists the dirs of entries
+// that have to succeed before this one is dispatched, Inputs_from those of them whose outputs it needs.
+// Entries with a higher Priority go first. Within a priority, heavier entries go first, so long jobs do not
+// end up last, and entries of the same weight keep their order in the work file.
+type WorkEntry struct{
+    Dir string `json:"dir"`
+    Requires []string `json:"requires"`
+    Priority int `json:"priority"`
+    Weight float64 `json:"weight"`
+    Depends_on []string `json:"depends_on"`
+    Inputs_from []string `json:"inputs_from"`
+    Retry *RetryPolicy `json:"retry,omitempty"`
+    JobOptions
+    constraints []Constraint
+}
+
+func (w WorkEntry) command() Command{
+    return Command{Work_path: w.Dir, JobOptions: w.JobOptions}
+}
+
+type Work struct{
+    Hosts []string `json:"hosts"`
+    Work []WorkEntry `json:"work"`
+    Retry *RetryPolicy `json:"retry,omitempty"`
+}
+
+type InvalidJsonContent struct{}
+
+func (InvalidJsonContent) Error() string{
+    return "InvalidJsonContent"
+}
+
+func load_work() (Work, error){
+    var work Work
+    f,err:=os.Open("work.json")
+    if err!=nil{
+        return work, err
+    }
+    defer f.Close()
+
+    err=json.NewDecoder(f).Decode(&work)
+    if err!=nil{
+        return work, err
+    }
+
+    if len(work.Work)==0{
+        return work, InvalidJsonContent{}
+    }
+
+    for i:=range work.Work{
+        if len(work.Work[i].Dir)==0 || work.Work[i].Weight<0{
+            return work, InvalidJsonContent{}
+        }
+
+        work.Work[i].constraints, err=parse_constraints(work.Work[i].Requires)
+        if err!=nil{
+            return work, err
+        }
+
+        if work.Work[i].Retry==nil && work.Retry!=nil{
+            retry:=*work.Retry
+            work.Work[i].Retry=&retry
+        }
+        err=work.Work[i].Retry.validate()
+        if err!=nil{
+            return work, err
+        }
+    }
+
+    err=check_dependencies(work.Work)
+    if err!=nil{
+        return work, err
+    }
+
+    return work, nil
+}
+
+// Work comes from work.json if there is one, otherwise from work_paths.list, which only has directories.
+func load_work_or_work_paths() (Work, error){
+    work, err:=load_work()
+    if !os.IsNotExist(err){
+        return work, err
+    }
+
+    work_paths, err:=read_list_file("work_paths.list")
+    if err!=nil{
+        return work, err
+    }
+
+    work.Work=make([]WorkEntry, 0, len(work_paths))
+    for _,work_path:=range work_paths{
+        work.Work=append(work.Work, WorkEntry{Dir: work_path})
+    }
+    return work, nil
+}
+
+
+type MyClient struct{
+    client *http.Client
+    private_key *ecdsa.PrivateKey
+}
+
+type StatusCodeIsNotOk struct{
+    content string
+    host string
+    code int
+}
+
+func (s StatusCodeIsNotOk) Error() string{
+    content:=""
+    host:=""
+    code:=""
+
+    if len(s.content)!=0{
+        content=fmt.Sprintf("(content=%s)", s.content)
+    }
+
+    if len(s.host)!=0{
+        host=fmt.Sprintf("(host=%s)", s.host)
+    }
+
+    if s.code!=0{
+        code=fmt.Sprintf("(code=%d)", s.code)
+    }
+
+    return fmt.Sprintf("StatusCodeIsNotOk%s%s%s", host, content, code)
+}
+
+type ServerError struct{
+    host string
+    code int
+    error_message ErrorMessage
+}
+
+func (s ServerError) Error() string{
+    return fmt.Sprintf("ServerError(host=%s)(code=%d)(error=%s): %s", s.host, s.code, s.error_message.Code, s.error_message.Message)
+}
+
+// Returns the error code of a ServerError, or "" for anything else.
+func error_code(err error) string{
+    server_error, ok:=err.(ServerError)
+    if !ok{
+        return ""
+    }
+    return server_error.error_message.Code
+}
+
+// Only servers with structured errors say an error is for good, anything else may go away when tried again.
+func is_retryable(err error) bool{
+    server_error, ok:=err.(ServerError)
+    if !ok{
+        return true
+    }
+    return server_error.error_message.Retryable
+}
+
+// Servers with structured errors answer with an ErrorMessage, older ones with a bare word.
+func read_error(host string, response *http.Response) error{
+    content, err:=ioutil.ReadAll(response.Body)
+    response.Body.Close()
+    if err!=nil{
+        return StatusCodeIsNotOk{host: host, code: response.StatusCode, content: "Could not read: "+err.Error()}
+    }
+
+    var error_message ErrorMessage
+    err=json.Unmarshal(content, &error_message)
+    if err!=nil || len(error_message.Code)==0{
+        return StatusCodeIsNotOk{host: host, code: response.StatusCode, content: string(content)}
+    }
+    return ServerError{host: host, code: response.StatusCode, error_message: error_message}
+}
+
+// Servers with api_v2 get the strictly checked routes, older ones the original ones.
+func endpoint_url(host string, health HealthMessage, v2_path string, legacy_path string) string{
+    if health.supports(FEATURE_API_V2){
+        return fmt.Sprintf("http://%s:4753/api/v2/%s", host, v2_path)
+    }
+    return fmt.Sprintf("http://%s:4753/api/%s", host, legacy_path)
+}
+
+func (c MyClient) is_host_busy(host string, health HealthMessage) (bool, error){
+    response, err:=c.client.Get(endpoint_url(host, health, "busy", "is_busy"))
+    if err!=nil{
+        return false, err
+    }
+
+    if response.StatusCode!=200{
+        return false, read_error(host, response)
+    }
+
+    var busy_message BusyMessage
+    err=json.NewDecoder(response.Body).Decode(&busy_message)
+    return busy_message.Busy, err
+}
+
+func (c MyClient) get_nonce(host string, health HealthMessage) (uint64, error){
+    response, err:=c.client.Get(endpoint_url(host, health, "nonce", "get_nonce"))
+    if err!=nil{
+        return 0, err
+    }
+
+    if response.StatusCode!=200{
+        return 0, read_error(host, response)
+    }
+
+    var nonce_message NonceMessage
+    err=json.NewDecoder(response.Body).Decode(&nonce_message)
+    return nonce_message.Nonce, err
+}
+
+// Servers without job status send no job id, only jobs with outputs get an artifact token.
+func (c MyClient) send_work(host string, health HealthMessage, command_message Command) (WorkMessage, error){
+    var work_message WorkMessage
+    var buffer bytes.Buffer
+    err:=json.NewEncoder(&buffer).Encode(&command_message)
+    if err!=nil{
+        return work_message, err
+    }
+
+    response, err:=c.client.Post(endpoint_url(host, health, "work", "work"), "application/json", &buffer)
+    if err!=nil{
+        return work_message, err
+    }
+
+    if response.StatusCode!=200{
+        return work_message, read_error(host, response)
+    }
+    defer response.Body.Close()
+
+    if !health.supports(FEATURE_JOB_STATUS){
+        return work_message, nil
+    }
+
+    err=json.NewDecoder(response.Body).Decode(&work_message)
+    return work_message, err
+}
+
+// Needs no nonce, so claiming and submitting take one round trip each.
+func (c MyClient) claim(host string) (ClaimMessage, error){
+    var claim_message ClaimMessage
+    var random_bytes [8]byte
+    _, err:=rand.Read(random_bytes[:])
+    if err!=nil{
+        return claim_message, err
+    }
+
+    // Never 0, which the server takes for a missing value.
+    claim_request:=ClaimRequest{Timestamp_ms: time.Now().UnixMilli(), Random: binary.BigEndian.Uint64(random_bytes[:])|1}
+    hash_to_sign:=sha256.Sum256([]byte(claim_request.string_to_sign()))
+    r,s,err:=ecdsa.Sign(rand.Reader, c.private_key, hash_to_sign[:])
+    if err!=nil{
+        return claim_message, err
+    }
+    claim_request.Signature_r=r.String()
+    claim_request.Signature_s=s.String()
+
+    var buffer bytes.Buffer
+    err=json.NewEncoder(&buffer).Encode(&claim_request)
+    if err!=nil{
+        return claim_message, err
+    }
+
+    response, err:=c.client.Post(fmt.Sprintf("http://%s:4753/api/v2/claim", host), "application/json", &buffer)
+    if err!=nil{
+        return claim_message, err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode!=200{
+        return claim_message, read_error(host, response)
+    }
+
+    err=json.NewDecoder(response.Body).Decode(&claim_message)
+    return claim_message, err
+}
+
+func (c MyClient) get_info(host string, health HealthMessage) (InfoMessage, error){
+    var info_message InfoMessage
+    response, err:=c.client.Get(endpoint_url(host, health, "info", "info"))
+    if err!=nil{
+        return info_message, err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode!=200{
+        return info_message, read_error(host, response)
+    }
+
+    err=json.NewDecoder(response.Body).Decode(&info_message)
+    return info_message, err
+}
+
+// Servers from before /api/health answer it with 404 and are taken to speak the legacy protocol.
+func (c MyClient) get_health(host string) (HealthMessage, error){
+    var health_message HealthMessage
+    response, err:=c.client.Get(fmt.Sprintf("http://%s:4753/api/health", host))
+    if err!=nil{
+        return health_message, err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode==http.StatusNotFound{
+        return legacy_health(), nil
+    }
+
+    if response.StatusCode!=200{
+        return health_message, StatusCodeIsNotOk{host: host, code: response.StatusCode}
+    }
+
+    err=json.NewDecoder(response.Body).Decode(&health_message)
+    if err!=nil{
+        return health_message, err
+    }
+
+    if !health_message.is_compatible(){
+        return health_message, IncompatibleProtocol{host: host, protocol_version: health_message.Protocol_version, min_protocol_version: health_message.Min_protocol_version}
+    }
+    return health_message, nil
+}
+
+type RankedHost struct{
+    host string
+    health HealthMessage
+    info InfoMessage
+    has_info bool
+}
+
+// Lower is better, a host with a free slot always beats one without.
+func (r RankedHost) load() float64{
+    cpus:=r.info.Cpus
+    if cpus<1{
+        cpus=1
+    }
+
+    load:=r.info.Load_averages[0]/float64(cpus)
+    if r.info.Busy || r.info.Slots_used>=r.info.Slots{
+        load+=1000
+    }
+    return load
+}
+
+// Hosts that are down or speak a protocol this client does not are an error.
+func (c MyClient) query_host(host string) (RankedHost, error){
+    health, err:=c.get_health(host)
+    if err!=nil{
+        return RankedHost{}, err
+    }
+
+    ranked_host:=RankedHost{host: host, health: health}
+    if health.supports(FEATURE_INFO){
+        ranked_host.info, err=c.get_info(host, health)
+        ranked_host.has_info=err==nil
+    }
+    return ranked_host, nil
+}
+
+// Orders hosts least loaded first. Hosts that do not answer /api/info (e.g. older servers) go last, in their original order.
+func sort_ranked_hosts(ranked_hosts []RankedHost){
+    sort.SliceStable(ranked_hosts, func(i, j int) bool{
+        if ranked_hosts[i].has_info!=ranked_hosts[j].has_info{
+            return ranked_hosts[i].has_info
+        }
+        if !ranked_hosts[i].has_info{
+            return false
+        }
+        return ranked_hosts[i].load()<ranked_hosts[j].load()
+    })
+}
+
+const STALE_NONCE_ATTEMPTS = 3
+
+// Signs the command with a fresh nonce and sends it, if the host is not busy. Returns the job, and a nil error
+// if the host accepted it. Another client can use the nonce up between getting and sending it, then a new one is fetched.
+func (c MyClient) try_host(ranked_host RankedHost, command Command) (WorkMessage, error){
+    host:=ranked_host.host
+    if ranked_host.health.supports(FEATURE_CLAIM){
+        return c.try_claim(host, ranked_host.health, command)
+    }
+
+    busy,err:=c.is_host_busy(host, ranked_host.health)
+    if err!=nil{
+        log_error("Error checking if host is busy", err, "server", host)
+        return WorkMessage{}, err
+    }
+
+    if busy{
+        return WorkMessage{}, ServerError{host: host, error_message: new_error_message(ERROR_BUSY, "host says it is busy", nil)}
+    }
+
+    var work_message WorkMessage
+    for attempt:=1;;attempt++{
+        work_message, err=c.sign_and_send(host, ranked_host.health, command)
+        if error_code(err)!=ERROR_STALE_NONCE || attempt==STALE_NONCE_ATTEMPTS{
+            break
+        }
+        log_warning("Nonce went stale, getting a new one", "server", host, "work_path", command.Work_path)
+    }
+
+    if err!=nil{
+        log_error("Error sending work", err, "server", host, "work_path", command.Work_path)
+    }
+    return work_message, err
+}
+
+// Claiming takes a slot and gets the challenge in one round trip, so no other client can take the slot
+// between checking and sending. A lease that ran out before the work got there is claimed again once.
+func (c MyClient) try_claim(host string, health HealthMessage, command Command) (WorkMessage, error){
+    var work_message WorkMessage
+    var err error
+    for attempt:=1;attempt<=2;attempt++{
+        var claim_message ClaimMessage
+        claim_message, err=c.claim(host)
+        if err!=nil{
+            break
+        }
+
+        command.Lease=claim_message.Lease
+        work_message, err=c.sign_and_send_with(host, health, command, claim_message.Challenge)
+        if error_code(err)!=ERROR_LEASE_EXPIRED{
+            break
+        }
+        log_warning("Lease expired, claiming again", "server", host, "work_path", command.Work_path)
+    }
+
+    if err!=nil && error_code(err)!=ERROR_BUSY && error_code(err)!=ERROR_IN_USE && error_code(err)!=ERROR_TOO_MANY_LEASES{
+        log_error("Error sending work", err, "server", host, "work_path", command.Work_path)
+    }
+    return work_message, err
+}
+
+func (c MyClient) sign_and_send(host string, health HealthMessage, command Command) (WorkMessage, error){
+    nonce,err:=c.get_nonce(host, health)
+    if err!=nil{
+        return WorkMessage{}, err
+    }
+    return c.sign_and_send_with(host, health, command, nonce)
+}
+
+func (c MyClient) sign_and_send_with(host string, health HealthMessage, command Command, nonce uint64) (WorkMessage, error){
+    if nonce==0{
+        return WorkMessage{}, NonceIsZero{host: host}
+    }
+
+    string_to_sign, err:=command.string_to_sign(nonce)
+    if err!=nil{
+        return WorkMessage{}, err
+    }
+
+    hash_to_sign:=sha256.Sum256([]byte(string_to_sign))
+    r,s,err:=ecdsa.Sign(rand.Reader, c.private_key, hash_to_sign[:])
+    if err!=nil{
+        return WorkMessage{}, err
+    }
+
+    command.Nonce=nonce
+    command.Signature_r=r.String()
+    command.Signature_s=s.String()
+    return c.send_work(host, health, command)
+}
+
+type NonceIsZero struct{
+    host string
+}
+
+func (n NonceIsZero) Error() string{
+    return fmt.Sprintf("NonceIsZero(host=%s)", n.host)
+}
+
+func subtract_or_zero(a uint64, b uint64) uint64{
+    if b>a{
+        return 0
+    }
+    return a-b
+}
+
+func (r RankedHost) free_resources() JobResources{
+    return JobResources{
+        Cpus: math.Max(r.info.Capacity.Cpus-r.info.Reserved.Cpus, 0),
+        Memory_bytes: subtract_or_zero(r.info.Capacity.Memory_bytes, r.info.Reserved.Memory_bytes),
+        Disk_bytes: subtract_or_zero(r.info.Capacity.Disk_bytes, r.info.Reserved.Disk_bytes),
+    }
+}
+
+func covers(available JobResources, request JobResources) bool{
+    return request.Cpus<=available.Cpus && request.Memory_bytes<=available.Memory_bytes && request.Disk_bytes<=available.Disk_bytes
+}
+
+// How much of the host would be left unreserved after placing the request, as a fraction of its capacity summed over
+// cpu, memory and disk. Picking the smallest leftover packs jobs tightly and keeps big hosts free for big jobs.
+func (r RankedHost) leftover(request JobResources) float64{
+    free:=r.free_resources()
+    leftover:=0.0
+    if r.info.Capacity.Cpus>0{
+        leftover+=(free.Cpus-request.Cpus)/r.info.Capacity.Cpus
+    }
+    if r.info.Capacity.Memory_bytes>0{
+        leftover+=(float64(free.Memory_bytes)-float64(request.Memory_bytes))/float64(r.info.Capacity.Memory_bytes)
+    }
+    if r.info.Capacity.Disk_bytes>0{
+        leftover+=(float64(free.Disk_bytes)-float64(request.Disk_bytes))/float64(r.info.Capacity.Disk_bytes)
+    }
+    return leftover
+}
+
+// Hosts without info can not say what they have, so they only get work without requirements or resource requests.
+// Servers without job options would not verify the signature over them, so they only get plain work.
+// Followed entries need a host that can say how their job went.
+func (r RankedHost) can_ever_run(entry WorkEntry, followed bool) bool{
+    if followed && !r.health.supports(FEATURE_JOB_STATUS){
+        return false
+    }
+    if !entry.JobOptions.is_empty() && !r.health.supports(FEATURE_JOB_OPTIONS){
+        return false
+    }
+    if (entry.has_artifacts() || len(entry.Inputs_from)!=0) && !r.health.supports(FEATURE_ARTIFACTS){
+        return false
+    }
+    if !r.satisfies(entry.constraints){
+        return false
+    }
+    if entry.Resources==nil{
+        return true
+    }
+    return r.has_info && covers(r.info.Capacity, *entry.Resources)
+}
+
+// Work with resource requests goes to the host it fits best, other work keeps the order the scheduler chose.
+func candidate_hosts(ranked_hosts []RankedHost, entry WorkEntry, followed bool) []RankedHost{
+    candidates:=make([]RankedHost, 0, len(ranked_hosts))
+    for _,ranked_host:=range ranked_hosts{
+        if !ranked_host.can_ever_run(entry, followed){
+            continue
+        }
+        if entry.Resources!=nil && !covers(ranked_host.free_resources(), *entry.Resources){
+            continue
+        }
+        candidates=append(candidates, ranked_host)
+    }
+
+    if entry.Resources!=nil{
+        sort.SliceStable(candidates, func(i, j int) bool{
+            return candidates[i].leftover(*entry.Resources)<candidates[j].leftover(*entry.Resources)
+        })
+    }
+    return candidates
+}
+
+// Errors that no other host would answer differently, so there is no point in trying the entry elsewhere.
+func is_final_error(err error) bool{
+    switch error_code(err){
+    case ERROR_UNAUTHORIZED, ERROR_MALFORMED_REQUEST, ERROR_INVALID_REQUEST:
+        return true
+    }
+    return false
+}
+
+// False when hosts answered but none of them could ever run the entry.
+func is_satisfiable(ranked_hosts []RankedHost, entry WorkEntry, followed bool) bool{
+    if len(ranked_hosts)==0{
+        return true
+    }
+    for _,ranked_host:=range ranked_hosts{
+        if followed && !ranked_host.health.supports(FEATURE_JOB_STATUS){
+            continue
+        }
+        // A host that has /api/info but did not answer it could still turn out to run the entry.
+        if ranked_host.can_ever_run(entry, followed) || (!ranked_host.has_info && ranked_host.health.supports(FEATURE_INFO)){
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,157 @@
+package main;
+
+import "encoding/json"
+import "os"
+
+const STATE_DISPATCHED = "dispatched"
+
+// One line per attempt, as in the report. A job is retried when a later attempt for the same work path
+// exists, so that is not stored.
+type StateJob struct{
+    Work_path string `json:"work_path"`
+    Host string `json:"host"`
+    Health HealthMessage `json:"health"`
+    Job string `json:"job"`
+    Artifact_token string `json:"artifact_token,omitempty"`
+    Attempt int `json:"attempt"`
+    State string `json:"state"`
+    Outcome string `json:"outcome,omitempty"`
+    Exit_code *int `json:"exit_code,omitempty"`
+    Duration_seconds float64 `json:"duration_seconds,omitempty"`
+    Log_path string `json:"log_path,omitempty"`
+}
+
+type StateFile struct{
+    Jobs []StateJob `json:"jobs"`
+}
+
+// Where the client keeps what it dispatched, so a restarted client picks up where the last one stopped.
+// An empty path keeps nothing.
+type RunState struct{
+    path string
+}
+
+func (r RunState) load() (StateFile, error){
+    var state StateFile
+    if len(r.path)==0{
+        return state, nil
+    }
+
+    f, err:=os.Open(r.path)
+    if os.IsNotExist(err){
+        return state, nil
+    }
+    if err!=nil{
+        return state, err
+    }
+    defer f.Close()
+
+    err=json.NewDecoder(f).Decode(&state)
+    return state, err
+}
+
+// Writes a new file and renames it over the old one, so a client killed halfway leaves the last complete state.
+func (r RunState) save(tracked_jobs []*TrackedJob){
+    if len(r.path)==0{
+        return
+    }
+
+    state:=StateFile{Jobs: make([]StateJob, 0, len(tracked_jobs))}
+    for _,tracked_job:=range tracked_jobs{
+        job_state:=tracked_job.status.State
+        if len(job_state)==0{
+            job_state=STATE_DISPATCHED
+        }
+        state.Jobs=append(state.Jobs, StateJob{
+            Work_path: tracked_job.entry.Dir,
+            Host: tracked_job.host,
+            Health: tracked_job.health,
+            Job: tracked_job.job,
+            Artifact_token: tracked_job.artifact_token,
+            Attempt: tracked_job.attempt,
+            State: job_state,
+            Outcome: tracked_job.outcome,
+            Exit_code: tracked_job.status.Exit_code,
+            Duration_seconds: tracked_job.status.Duration_seconds,
+            Log_path: tracked_job.status.Log_path,
+        })
+    }
+
+    state_in_bytes, err:=json.MarshalIndent(&state, "", "    ")
+    if err!=nil{
+        log_error("Error encoding state", err)
+        return
+    }
+
+    temporary_path:=r.path+".tmp"
+    err=os.WriteFile(temporary_path, state_in_bytes, 0600)
+    if err==nil{
+        err=os.Rename(temporary_path, r.path)
+    }
+    if err!=nil{
+        log_error("Error saving state", err, "path", r.path)
+    }
+}
+
+// Puts the jobs of an earlier run back in place of their entries. Finished jobs are kept for the report and
+// for retries, unfinished ones are followed again. Entries are matched by work path, those the earlier run
+// never got to stay pending.
+func (d *Dispatcher) resume(state StateFile){
+    if len(state.Jobs)==0{
+        return
+    }
+
+    entries:=make(map[string]WorkEntry)
+    for _,work:=range d.pending{
+        entries[work.entry.Dir]=work.entry
+    }
+
+    latest:=make(map[string]*TrackedJob)
+    failed_hosts:=make(map[string]map[string]bool)
+    for _,job:=range state.Jobs{
+        entry, ok:=entries[job.Work_path]
+        if !ok{
+            continue
+        }
+
+        tracked_job:=&TrackedJob{
+            DispatchedJob: DispatchedJob{entry: entry, host: job.Host, health: job.Health, job: job.Job, artifact_token: job.Artifact_token, attempt: job.Attempt},
+            outcome: job.Outcome,
+        }
+        if job.State!=STATE_DISPATCHED{
+            tracked_job.status=JobStatusMessage{Job: job.Job, Work_path: job.Work_path, State: job.State, Outcome: job.Outcome, Exit_code: job.Exit_code, Duration_seconds: job.Duration_seconds, Log_path: job.Log_path}
+        }
+
+        previous, ok:=latest[job.Work_path]
+        if ok{
+            previous.retried=true
+        }
+        latest[job.Work_path]=tracked_job
+
+        tracked_job.failed_hosts=failed_hosts[job.Work_path]
+        if tracked_job.done() && tracked_job.outcome!=JOB_OUTCOME_SUCCEEDED{
+            hosts:=map[string]bool{job.Host: true}
+            for host:=range tracked_job.failed_hosts{
+                hosts[host]=true
+            }
+            failed_hosts[job.Work_path]=hosts
+        }
+        d.tracked=append(d.tracked, tracked_job)
+    }
+
+    still_pending:=make([]PendingWork, 0, len(d.pending))
+    for _,work:=range d.pending{
+        if _, ok:=latest[work.entry.Dir]; !ok{
+            still_pending=append(still_pending, work)
+        }
+    }
+    d.pending=still_pending
+
+    unfinished:=0
+    for _,tracked_job:=range latest{
+        if !tracked_job.done(){
+            unfinished++
+        }
+    }
+    log_info("Resuming earlier run", "dispatched", len(latest), "unfinished", unfinished, "pending", len(d.pending))
+}
@@ -0,0 +1,162 @@
+package main;
+
+import "encoding/json"
+import "text/tabwriter"
+import "net/http"
+import "fmt"
+import "os"
+
+// Outcomes the client gives jobs it could not follow to the end.
+const JOB_OUTCOME_UNTRACKED = "untracked"
+const JOB_OUTCOME_LOST = "lost"
+const JOB_OUTCOME_UNSATISFIABLE = "unsatisfiable"
+const JOB_OUTCOME_REJECTED = "rejected"
+
+// A host that stays unreachable for this many polls in a row is given up on.
+const MAX_STATUS_FAILURES = 30
+
+// Without -wait the client has always exited 0 when it could not even start, scripts that check the exit status
+// pass -wait.
+func exit_if_waiting(wait bool){
+    if wait{
+        os.Exit(1)
+    }
+}
+
+func (c MyClient) get_job_status(host string, job string) (JobStatusMessage, error){
+    var status JobStatusMessage
+    response, err:=c.client.Get(fmt.Sprintf("http://%s:4753/api/v2/jobs/%s", host, job))
+    if err!=nil{
+        return status, err
+    }
+
+    if response.StatusCode!=http.StatusOK{
+        return status, read_error(host, response)
+    }
+    defer response.Body.Close()
+
+    err=json.NewDecoder(response.Body).Decode(&status)
+    return status, err
+}
+
+type TrackedJob struct{
+    DispatchedJob
+    status JobStatusMessage
+    outcome string
+    failures int
+    retried bool
+}
+
+func (t *TrackedJob) done() bool{
+    return len(t.outcome)!=0
+}
+
+func (t *TrackedJob) poll(client MyClient){
+    if len(t.job)==0 || !t.health.supports(FEATURE_JOB_STATUS){
+        t.outcome=JOB_OUTCOME_UNTRACKED
+        return
+    }
+
+    status, err:=client.get_job_status(t.host, t.job)
+    switch{
+    case err==nil:
+        t.failures=0
+        t.status=status
+        if status.State==JOB_STATE_FINISHED{
+            t.outcome=status.Outcome
+        }
+    case error_code(err)==ERROR_UNKNOWN_JOB:
+        // The server restarted or forgot the job, either way it will never say how it ended.
+        log_error("Server no longer knows the job", err, "server", t.host, "job", t.job)
+        t.outcome=JOB_OUTCOME_LOST
+    default:
+        t.failures++
+        if t.failures>=MAX_STATUS_FAILURES{
+            log_error("Giving up on job status", err, "server", t.host, "job", t.job)
+            t.outcome=JOB_OUTCOME_LOST
+        }
+    }
+}
+
+// Polls the status of every dispatched job until all of them finished, woken up early by job events.
+func wait_for_jobs(client MyClient, watcher EventWatcher, run_state RunState, tracked_jobs []*TrackedJob, workers int) []*TrackedJob{
+    for{
+        tasks:=make([]func(), 0, len(tracked_jobs))
+        for _,tracked_job:=range tracked_jobs{
+            if !tracked_job.done(){
+                tasks=append(tasks, func(tracked_job *TrackedJob) func(){
+                    return func(){ tracked_job.poll(client) }
+                }(tracked_job))
+            }
+        }
+        if len(tasks)==0{
+            return tracked_jobs
+        }
+
+        run_pool(workers, tasks)
+        run_state.save(tracked_jobs)
+
+        unfinished:=0
+        for _,tracked_job:=range tracked_jobs{
+            if !tracked_job.done(){
+                unfinished++
+            }
+        }
+        if unfinished==0{
+            return tracked_jobs
+        }
+
+        log_info("Waiting for jobs", "unfinished", unfinished)
+        watcher.wait()
+    }
+}
+
+func format_duration(seconds float64) string{
+    if seconds<=0{
+        return "-"
+    }
+    return fmt.Sprintf("%.1fs", seconds)
+}
+
+// Prints one line per attempt and returns whether any entry did not succeed. Untracked jobs are not known to
+// have failed, and retried attempts were followed by another one, so neither counts.
+func print_report(tracked_jobs []*TrackedJob, unsatisfiable []string, rejected []string, skipped []string) bool{
+    failed:=len(unsatisfiable)!=0 || len(rejected)!=0 || len(skipped)!=0
+
+    writer:=tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(writer, "HOST\tPATH\tJOB\tATTEMPT\tOUTCOME\tEXIT\tDURATION\tLOG")
+    for _,tracked_job:=range tracked_jobs{
+        exit_code:="-"
+        if tracked_job.status.Exit_code!=nil{
+            exit_code=fmt.Sprint(*tracked_job.status.Exit_code)
+        }
+
+        job:=tracked_job.job
+        if len(job)==0{
+            job="-"
+        }
+
+        log_path:=tracked_job.status.Log_path
+        if len(log_path)==0{
+            log_path="server output"
+        }
+
+        if tracked_job.outcome!=JOB_OUTCOME_SUCCEEDED && tracked_job.outcome!=JOB_OUTCOME_UNTRACKED && !tracked_job.retried{
+            failed=true
+        }
+        fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", tracked_job.host, tracked_job.entry.Dir, job, tracked_job.attempt, tracked_job.outcome, exit_code, format_duration(tracked_job.status.Duration_seconds), log_path)
+    }
+
+    for _,work_path:=range unsatisfiable{
+        fmt.Fprintf(writer, "-\t%s\t-\t-\t%s\t-\t-\t-\n", work_path, JOB_OUTCOME_UNSATISFIABLE)
+    }
+    for _,work_path:=range rejected{
+        fmt.Fprintf(writer, "-\t%s\t-\t-\t%s\t-\t-\t-\n", work_path, JOB_OUTCOME_REJECTED)
+    }
+    for _,work_path:=range skipped{
+        fmt.Fprintf(writer, "-\t%s\t-\t-\t%s\t-\t-\t-\n", work_path, JOB_OUTCOME_SKIPPED)
+    }
+    writer.Flush()
+
+    return failed
+}
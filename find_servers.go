@@ -1,5 +1,6 @@
 package main;
 
+import "encoding/json"
 import "net/http"
 import "time"
 import "sync"
@@ -19,10 +20,26 @@ func main() {
         go func(i int){
             defer wait_group.Done()
             host:=fmt.Sprintf("c%03d", i)
-            _, err:=client.Head(fmt.Sprintf("http://%s:4753/api/is_busy", host))
-            if err==nil{
-                fmt.Println(host)
+            response, err:=client.Get(fmt.Sprintf("http://%s:4753/api/health", host))
+            if err!=nil{
+                return
             }
+            defer response.Body.Close()
+
+            health:=legacy_health()
+            if response.StatusCode!=http.StatusNotFound{
+                err=json.NewDecoder(response.Body).Decode(&health)
+                if err!=nil{
+                    fmt.Fprintln(os.Stderr, "Error decoding health of", host, err)
+                    return
+                }
+            }
+
+            if !health.is_compatible(){
+                fmt.Fprintf(os.Stderr, "%s: version %s speaks protocol %d..%d, skipping\n", host, health.Version, health.Min_protocol_version, health.Protocol_version)
+                return
+            }
+            fmt.Println(host)
         }(i)
     }
 
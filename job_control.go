@@ -0,0 +1,96 @@
+package main;
+
+import "encoding/json"
+import "crypto/sha256"
+import "crypto/ecdsa"
+import "crypto/rand"
+import "net/http"
+import "bytes"
+import "time"
+import "fmt"
+import "os"
+
+func usage(){
+    fmt.Fprintln(os.Stderr, "Usage: job_control <host> suspend <job_id> [release_slot]")
+    fmt.Fprintln(os.Stderr, "       job_control <host> resume <job_id>")
+}
+
+func main() {
+    if len(os.Args)<4 || len(os.Args)>5{
+        usage()
+        return
+    }
+
+    host:=os.Args[1]
+    action:=os.Args[2]
+    job_id:=os.Args[3]
+    if action!=JOB_CONTROL_SUSPEND && action!=JOB_CONTROL_RESUME{
+        usage()
+        return
+    }
+
+    control_message:=JobControlMessage{Keep_slot: true}
+    if len(os.Args)==5{
+        if action!=JOB_CONTROL_SUSPEND || os.Args[4]!="release_slot"{
+            usage()
+            return
+        }
+        control_message.Keep_slot=false
+    }
+
+    private_key,err:=load_private_key()
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error loading key:", err)
+        return
+    }
+
+    client:=MyClient{client: &http.Client{Timeout: 5*time.Second}, private_key: private_key}
+
+    health, err:=client.get_health(host)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error checking health:", err)
+        return
+    }
+
+    if !health.is_compatible() || !health.supports(FEATURE_JOB_CONTROL){
+        fmt.Fprintf(os.Stderr, "Error: %s runs version %s, which does not support job control\n", host, health.Version)
+        return
+    }
+
+    nonce, err:=client.get_nonce(host, health)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error getting nonce:", err)
+        return
+    }
+
+    hash_to_sign:=sha256.Sum256([]byte(control_message.string_to_sign(action, job_id, nonce)))
+    r,s,err:=ecdsa.Sign(rand.Reader, private_key, hash_to_sign[:])
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error signing:", err)
+        return
+    }
+    control_message.Nonce=nonce
+    control_message.Signature_r=r.String()
+    control_message.Signature_s=s.String()
+
+    var buffer bytes.Buffer
+    err=json.NewEncoder(&buffer).Encode(&control_message)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error encoding job control:", err)
+        return
+    }
+
+    job_path:=fmt.Sprintf("jobs/%s/%s", job_id, action)
+    response, err:=client.client.Post(endpoint_url(host, health, job_path, job_path), "application/json", &buffer)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error sending job control:", err)
+        return
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode!=200{
+        fmt.Fprintln(os.Stderr, "Error:", read_error(host, response))
+        return
+    }
+    fmt.Println("Job", job_id, "on", host, "got", action)
+}
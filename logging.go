@@ -0,0 +1,130 @@
+package main;
+
+import "encoding/json"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "fmt"
+import "io"
+import "os"
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+const LOG_FORMAT_LOGFMT = "logfmt"
+
+const LOG_LEVEL_INFO = "info"
+const LOG_LEVEL_WARNING = "warning"
+const LOG_LEVEL_ERROR = "error"
+
+// Fields are key value pairs, like log_error("Error sending work", err, "server", host).
+// Info goes to stdout and everything else to stderr, whatever the format.
+type Logger struct{
+    mutex *sync.Mutex
+    format string
+    host string
+}
+
+var logger = Logger{mutex: &sync.Mutex{}, format: LOG_FORMAT_TEXT}
+
+type UnknownLogFormat struct{
+    format string
+}
+
+func (u UnknownLogFormat) Error() string{
+    return fmt.Sprintf("UnknownLogFormat(%s)", u.format)
+}
+
+func set_log_format(format string) error{
+    switch format{
+    case LOG_FORMAT_TEXT, LOG_FORMAT_JSON, LOG_FORMAT_LOGFMT:
+    default:
+        return UnknownLogFormat{format: format}
+    }
+
+    host, err:=os.Hostname()
+    if err!=nil{
+        return err
+    }
+
+    logger.format=format
+    logger.host=host
+    return nil
+}
+
+func log_info(message string, fields ...interface{}){
+    logger.write(os.Stdout, LOG_LEVEL_INFO, message, nil, fields)
+}
+
+func log_warning(message string, fields ...interface{}){
+    logger.write(os.Stderr, LOG_LEVEL_WARNING, message, nil, fields)
+}
+
+func log_error(message string, err error, fields ...interface{}){
+    logger.write(os.Stderr, LOG_LEVEL_ERROR, message, err, fields)
+}
+
+func logfmt_value(value string) string{
+    if len(value)==0 || strings.ContainsAny(value, " =\"\t\n"){
+        return strconv.Quote(value)
+    }
+    return value
+}
+
+func (l Logger) write(w io.Writer, level string, message string, err error, fields []interface{}){
+    keys:=make([]string, 0, len(fields)/2)
+    values:=make([]string, 0, len(fields)/2)
+    for i:=0;i+1<len(fields);i+=2{
+        keys=append(keys, fmt.Sprint(fields[i]))
+        values=append(values, fmt.Sprint(fields[i+1]))
+    }
+
+    var line string
+    switch l.format{
+    case LOG_FORMAT_JSON:
+        record:=map[string]string{
+            "time": time.Now().Format(time.RFC3339Nano),
+            "level": level,
+            "host": l.host,
+            "msg": message,
+        }
+        if err!=nil{
+            record["error"]=err.Error()
+        }
+        for i,key:=range keys{
+            record[key]=values[i]
+        }
+
+        record_in_bytes, marshal_err:=json.Marshal(record)
+        if marshal_err!=nil{
+            record_in_bytes=[]byte(strconv.Quote(message))
+        }
+        line=string(record_in_bytes)
+    case LOG_FORMAT_LOGFMT:
+        parts:=[]string{
+            "time="+time.Now().Format(time.RFC3339Nano),
+            "level="+level,
+            "host="+logfmt_value(l.host),
+            "msg="+logfmt_value(message),
+        }
+        if err!=nil{
+            parts=append(parts, "error="+logfmt_value(err.Error()))
+        }
+        for i,key:=range keys{
+            parts=append(parts, key+"="+logfmt_value(values[i]))
+        }
+        line=strings.Join(parts, " ")
+    default:
+        line=message
+        if err!=nil{
+            line+=": "+err.Error()
+        }
+        for i,key:=range keys{
+            line+=" "+key+"="+values[i]
+        }
+    }
+
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    fmt.Fprintln(w, line)
+}
@@ -1,3 +1,5 @@
+// Job routes use {id} patterns, which need the Go 1.22 mux even when built without a go.mod.
+//go:debug httpmuxgo121=0
 package main;
 
 import "encoding/json"
@@ -6,10 +8,13 @@ import "crypto/ecdsa"
 import "crypto/x509"
 import "crypto/rand"
 import "sync/atomic"
+import "sync"
+import "path/filepath"
 import "io/ioutil"
 import "net/http"
+import "flag"
 import "math/big"
-import "os/exec"
+import "syscall"
 import "time"
 import "fmt"
 import "os"
@@ -28,6 +33,16 @@ func load_public_key() (*ecdsa.PublicKey, error){
     return &private_key.PublicKey, nil
 }
 
+func key_fingerprint(public_key *ecdsa.PublicKey) (string, error){
+    key_in_bytes, err:=x509.MarshalPKIXPublicKey(public_key)
+    if err!=nil{
+        return "", err
+    }
+
+    hash:=sha256.Sum256(key_in_bytes)
+    return fmt.Sprintf("%x", hash[:8]), nil
+}
+
 type IncompleteRead struct{}
 
 func (IncompleteRead) Error() string{
@@ -70,6 +85,7 @@ func get_random_u64() (uint64, error){
 
 type Nonce struct{
     nonce *uint64
+    metrics Metrics
 }
 
 func (n Nonce) swap(new_nonce uint64) (uint64,error){
@@ -81,6 +97,19 @@ func (n Nonce) swap(new_nonce uint64) (uint64,error){
     return nonce, nil
 }
 
+// Only swaps if the nonce still is the expected one, so a client with a stale nonce does not use up the current one.
+func (n Nonce) swap_if(expected uint64, new_nonce uint64) (uint64,error){
+    if atomic.CompareAndSwapUint64(n.nonce, expected, new_nonce){
+        return expected, nil
+    }
+
+    nonce, err:=n.peek()
+    if err!=nil{
+        return 0, err
+    }
+    return 0, StaleNonce{expected: expected, nonce: nonce}
+}
+
 func (n Nonce) peek() (uint64,error){
     nonce:=atomic.LoadUint64(n.nonce)
     if nonce==0{
@@ -94,23 +123,24 @@ func (n Nonce) ServeHTTP(w http.ResponseWriter,r *http.Request){
     w.Header().Set("Content-Type", "application/json")
     nonce, err:=n.peek()
     if err!=nil || nonce==0{
-        fmt.Fprintln(os.Stderr, "Error getting nonce:", err)
+        n.metrics.increment(METRIC_NONCE_ERRORS, "")
+        log_error("Error getting nonce", err)
         new_nonce, err:=get_random_u64()
         if err!=nil{
-            fmt.Fprintln(os.Stderr, "Error generating new nonce:", err)
+            log_error("Error generating new nonce", err)
         } else{
             n.swap(new_nonce)
         }
 
-        w.WriteHeader(http.StatusInternalServerError)
-    } else{
-        w.WriteHeader(http.StatusOK)
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "nonce is in an error state", nil))
+        return
     }
 
+    w.WriteHeader(http.StatusOK)
     nonce_message:=NonceMessage{Nonce: nonce}
     err=json.NewEncoder(w).Encode(&nonce_message)
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error encoding nonce:", err)
+        log_error("Error encoding nonce", err)
     }
     return
 }
@@ -121,20 +151,38 @@ func (n Nonce) ServeHTTP(w http.ResponseWriter,r *http.Request){
 
 
 type Busy struct{
-    busy *int64
+    slots []int64
+    desktop Desktop
+    events Events
 }
 
-func (b Busy) is_busy() bool{
-    return atomic.LoadInt64(b.busy)!=0
+func (b Busy) is_slot_busy(slot int) bool{
+    return atomic.LoadInt64(&b.slots[slot])!=0
 }
 
-func (b Busy) make_busy() bool{ // retruns true if made busy, false if it already was busy
-    old:=atomic.SwapInt64(b.busy, 1)
-    return old==0
+func (b Busy) is_busy() bool{ // busy means every slot is taken
+    for i:=range b.slots{
+        if !b.is_slot_busy(i){
+            return false
+        }
+    }
+    return true
+}
+
+func (b Busy) make_busy() (int, bool){ // retruns the slot made busy, false if all slots already were busy
+    for i:=range b.slots{
+        if atomic.CompareAndSwapInt64(&b.slots[i], 0, 1){
+            return i, true
+        }
+    }
+    return 0, false
 }
 
-func (b Busy) make_free() bool{ // retruns true if made free, false if it already was free
-    old:=atomic.SwapInt64(b.busy, 0)
+func (b Busy) make_free(slot int) bool{ // retruns true if made free, false if it already was free
+    old:=atomic.SwapInt64(&b.slots[slot], 0)
+    if old!=0{
+        b.events.publish(EventMessage{Type: EVENT_SLOT_FREED, Slot: slot})
+    }
     return old!=0
 }
 
@@ -142,10 +190,10 @@ func (b Busy) ServeHTTP(w http.ResponseWriter,r *http.Request){
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusOK)
 
-    busy_message:=BusyMessage{Busy: b.is_busy()}
+    busy_message:=BusyMessage{Busy: b.is_busy() || b.desktop.is_in_use(), Paused: b.desktop.is_paused()}
     err:=json.NewEncoder(w).Encode(&busy_message)
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error encoding busy:", err)
+        log_error("Error encoding busy", err)
     }
     return
 }
@@ -153,10 +201,163 @@ func (b Busy) ServeHTTP(w http.ResponseWriter,r *http.Request){
 
 
 
+type InvalidSignature struct{}
+
+func (InvalidSignature) Error() string{
+    return "InvalidSignature"
+}
+
+type StaleNonce struct{
+    expected uint64
+    nonce uint64
+}
+
+func (s StaleNonce) Error() string{
+    return fmt.Sprintf("StaleNonce(expected=%x)(nonce=%x)", s.expected, s.nonce)
+}
+
+type SignatureDoesNotCheckOut struct{}
+
+func (SignatureDoesNotCheckOut) Error() string{
+    return "SignatureDoesNotCheckOut"
+}
+
+func parse_signature(signature_r string, signature_s string) (*big.Int, *big.Int, error){
+    signature_r_bigint:=new(big.Int)
+    signature_s_bigint:=new(big.Int)
+
+    _, err_r := fmt.Sscan(signature_r, signature_r_bigint)
+    _, err_s := fmt.Sscan(signature_s, signature_s_bigint)
+
+    if err_r!=nil || err_s!=nil{
+        return nil, nil, InvalidSignature{}
+    }
+    return signature_r_bigint, signature_s_bigint, nil
+}
+
+func verify_signature(public_key *ecdsa.PublicKey, signature_r *big.Int, signature_s *big.Int, nonce uint64, string_to_sign func(uint64) (string, error)) error{
+    string_to_check, err:=string_to_sign(nonce)
+    if err!=nil{
+        return err
+    }
+
+    hash_to_check:=sha256.Sum256([]byte(string_to_check))
+    if !ecdsa.Verify(public_key, hash_to_check[:], signature_r, signature_s){
+        return SignatureDoesNotCheckOut{}
+    }
+
+    return nil
+}
+
+// Every check uses up the nonce, whether the signature checks out or not. Clients that say which nonce they signed
+// (claimed_nonce is not 0) get StaleNonce instead if it is not the current one, and the current one stays unused.
+func check_signature(nonce Nonce, public_key *ecdsa.PublicKey, claimed_nonce uint64, signature_r string, signature_s string, string_to_sign func(uint64) (string, error)) error{
+    signature_r_bigint, signature_s_bigint, err:=parse_signature(signature_r, signature_s)
+    if err!=nil{
+        return err
+    }
+
+    new_nonce, err:=get_random_u64()
+    if err!=nil{
+        log_error("Error generating new nonce", err)
+    }
+
+    var old_nonce uint64
+    if claimed_nonce!=0{
+        old_nonce, err=nonce.swap_if(claimed_nonce, new_nonce)
+    } else{
+        old_nonce, err=nonce.swap(new_nonce)
+    }
+    if err!=nil{
+        return err
+    }
+
+    return verify_signature(public_key, signature_r_bigint, signature_s_bigint, old_nonce, string_to_sign)
+}
+
+// Work for a lease is signed over the lease's challenge instead of the nonce. The lease is used up either way.
+func check_lease_signature(leases Leases, lease_id string, public_key *ecdsa.PublicKey, signature_r string, signature_s string, string_to_sign func(uint64) (string, error)) (Lease, error){
+    lease, err:=leases.take(lease_id)
+    if err!=nil{
+        return lease, err
+    }
+
+    signature_r_bigint, signature_s_bigint, err:=parse_signature(signature_r, signature_s)
+    if err!=nil{
+        return lease, err
+    }
+    return lease, verify_signature(public_key, signature_r_bigint, signature_s_bigint, lease.challenge, string_to_sign)
+}
+
+func write_error(w http.ResponseWriter, status int, error_message ErrorMessage){
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    err:=json.NewEncoder(w).Encode(&error_message)
+    if err!=nil{
+        log_error("Error encoding error", err)
+    }
+}
+
+// Details carry the underlying error, for the people reading client logs.
+func error_details(err error, fields ...string) map[string]string{
+    details:=map[string]string{}
+    if err!=nil{
+        details["error"]=err.Error()
+    }
+    for i:=0;i+1<len(fields);i+=2{
+        details[fields[i]]=fields[i+1]
+    }
+    return details
+}
+
+func write_signature_error(w http.ResponseWriter, err error, metrics Metrics){
+    switch err.(type){
+    case NonceInErrorState:
+        metrics.increment(METRIC_NONCE_ERRORS, "")
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "nonce is in an error state", nil))
+    case UnknownLease:
+        write_error(w, http.StatusConflict, new_error_message(ERROR_LEASE_EXPIRED, "the lease expired or was used, claim again", nil))
+    case StaleNonce:
+        metrics.increment(METRIC_NONCE_ERRORS, "")
+        write_error(w, http.StatusConflict, new_error_message(ERROR_STALE_NONCE, "the nonce was used up, get a new one", nil))
+    case SignatureDoesNotCheckOut, InvalidSignature:
+        metrics.increment(METRIC_SIGNATURE_FAILURES, "")
+        write_error(w, http.StatusUnauthorized, new_error_message(ERROR_UNAUTHORIZED, "signature does not check out", nil))
+    default:
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "could not check signature", error_details(err)))
+    }
+    log_error("Error checking signature", err)
+}
+
+
+
+
+// Anything no other route matches.
+type NotFound struct{}
+
+func (NotFound) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    write_error(w, http.StatusNotFound, new_error_message(ERROR_NOT_FOUND, "no such endpoint", error_details(nil, "path", r.URL.Path)))
+}
+
+
+
+
 type Worker struct{
     nonce Nonce
+    leases Leases
     busy Busy
+    running RunningJobs
+    history JobHistory
+    reservations Reservations
+    metrics Metrics
     public_key *ecdsa.PublicKey
+    signer string
+    host string
+    base_env []string
+    config ServerConfig
+    credential *syscall.Credential
+    cgroup_root string
+    artifact_client *http.Client
 }
 
 func (o Worker) ServeHTTP(w http.ResponseWriter,r *http.Request){
@@ -165,78 +366,222 @@ func (o Worker) ServeHTTP(w http.ResponseWriter,r *http.Request){
     command_message:=Command{}
     err:=json.NewDecoder(r.Body).Decode(&command_message)
     if err!=nil{
-        w.WriteHeader(http.StatusBadRequest)
-        w.Write([]byte("error"))
-        fmt.Fprintln(os.Stderr, "Error decoding command:", err)
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "could not decode command", error_details(err)))
+        log_error("Error decoding command", err)
         return
     }
 
     work_path:=command_message.Work_path
-    signature_r:=command_message.Signature_r
-    signature_s:=command_message.Signature_s
+    // Work for a lease already holds a slot, every refusal from here on has to give it back.
+    leased_slot:=-1
+    started:=false
+    defer func(){
+        if leased_slot>=0 && !started{
+            o.busy.make_free(leased_slot)
+        }
+    }()
 
-    signature_r_bigint:=new(big.Int)
-    signature_s_bigint:=new(big.Int)
+    if len(command_message.Lease)!=0{
+        var lease Lease
+        lease, err=check_lease_signature(o.leases, command_message.Lease, o.public_key, command_message.Signature_r, command_message.Signature_s, command_message.string_to_sign)
+        if _, unknown:=err.(UnknownLease); !unknown{
+            leased_slot=lease.slot
+        }
+    } else{
+        err=check_signature(o.nonce, o.public_key, command_message.Nonce, command_message.Signature_r, command_message.Signature_s, command_message.string_to_sign)
+    }
+    if err!=nil{
+        write_signature_error(w, err, o.metrics)
+        return
+    }
 
-    _, err_r := fmt.Sscan(signature_r, signature_r_bigint)
-    _, err_s := fmt.Sscan(signature_s, signature_s_bigint)
+    if jobs_run_as_root(o.credential) && !o.config.Allow_root{
+        write_error(w, http.StatusForbidden, new_error_message(ERROR_ROOT_NOT_ALLOWED, "jobs would run as root", nil))
+        o.metrics.increment(METRIC_JOBS_REFUSED, label("reason", "root_not_allowed"))
+        log_error("Refusing to run job as root (set allow_root to permit it)", nil, "work_path", work_path)
+        return
+    }
 
-    if err_r!=nil || err_s!=nil{
-        w.WriteHeader(http.StatusBadRequest)
-        w.Write([]byte("error"))
-        fmt.Fprintln(os.Stderr, "Error decoding signature", err_r, err_s)
+    isolate, err:=isolate_job(o.config.Isolation, command_message.Isolate)
+    if err!=nil{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_ISOLATION_UNAVAILABLE, "isolation is not allowed on this server", nil))
+        o.metrics.increment(METRIC_JOBS_REFUSED, label("reason", "isolation_unavailable"))
+        log_error("Job asked for isolation but the server does not allow it", nil, "work_path", work_path)
         return
     }
 
-    new_nonce, err:=get_random_u64()
+    err=validate_environment(command_message.Env)
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error generating new nonce:", err)
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_INVALID_REQUEST, "invalid environment", error_details(err)))
+        log_error("Error validating environment", err, "work_path", work_path)
+        return
     }
 
-    nonce, err:=o.nonce.swap(new_nonce)
+    err=validate_artifacts(command_message.JobOptions)
     if err!=nil{
-        w.WriteHeader(http.StatusInternalServerError)
-        w.Write([]byte("error"))
-        fmt.Fprintln(os.Stderr, "Error getting nonce:", err)
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_INVALID_REQUEST, "invalid artifacts", error_details(err)))
+        log_error("Error validating artifacts", err, "work_path", work_path)
         return
     }
 
-    string_to_check:=fmt.Sprintf("$$%s$$%x$$", work_path, nonce)
-    hash_to_check:=sha256.Sum256([]byte(string_to_check))
+    var artifact_token string
+    if len(command_message.Outputs)!=0{
+        artifact_token, err=new_artifact_token()
+        if err!=nil{
+            write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not generate artifact token", nil))
+            log_error("Error generating artifact token", err, "work_path", work_path)
+            return
+        }
+    }
 
-    checks_out:=ecdsa.Verify(o.public_key, hash_to_check[:], signature_r_bigint, signature_s_bigint)
-    if !checks_out{
-        w.WriteHeader(http.StatusBadRequest)
-        w.Write([]byte("signature_error"))
-        fmt.Fprintln(os.Stderr, "Error verifying signature")
+    scheduling, err:=effective_scheduling(command_message.Scheduling, o.config.Scheduling)
+    if err!=nil{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_INVALID_REQUEST, "invalid scheduling", error_details(err)))
+        log_error("Error validating scheduling", err, "work_path", work_path)
         return
     }
 
-    if !o.busy.make_busy(){
-        w.WriteHeader(http.StatusPreconditionFailed)
-        w.Write([]byte("busy"))
-        fmt.Fprintln(os.Stderr, "Error: could not make busy")
+    if o.busy.desktop.is_in_use(){
+        write_error(w, http.StatusPreconditionFailed, new_error_message(ERROR_IN_USE, "machine is in use", nil))
+        o.metrics.increment(METRIC_JOBS_REFUSED, label("reason", "in_use"))
+        log_error("Machine is in use, not taking jobs", nil, "work_path", work_path)
         return
     }
 
-    go func(work_path string, busy Busy){
-        cmd:=exec.Command("make")
-        cmd.Stdout=os.Stdout
-        cmd.Stderr=os.Stderr
-        cmd.Dir=work_path
-        fmt.Println("Executing:", work_path)
-        err:=cmd.Run()
-        if !busy.make_free(){
-            fmt.Fprintln(os.Stderr, "Error: attempted to make busy free while it was already free")
-            return
-        }
-        if err!=nil{
-            fmt.Fprintln(os.Stderr, "Error while running command", err)
-            return
-        }
-        fmt.Println("Command was executed successfully:", work_path)
-    }(work_path, o.busy)
+    err=validate_resources(command_message.Resources)
+    if err!=nil{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_INVALID_REQUEST, "invalid resources", error_details(err)))
+        log_error("Error validating resources", err, "work_path", work_path)
+        return
+    }
+
+    var resources JobResources
+    if command_message.Resources!=nil{
+        resources=*command_message.Resources
+    }
+
+    err=o.reservations.reserve(resources)
+    if err!=nil{
+        write_error(w, http.StatusPreconditionFailed, new_error_message(ERROR_INSUFFICIENT_RESOURCES, "not enough unreserved resources", error_details(err)))
+        o.metrics.increment(METRIC_JOBS_REFUSED, label("reason", "insufficient_resources"))
+        log_error("Error reserving resources", err, "work_path", work_path)
+        return
+    }
+
+    slot, ok:=leased_slot, leased_slot>=0
+    if !ok{
+        slot, ok=o.busy.make_busy()
+    }
+    if !ok{
+        o.reservations.release(resources)
+        write_error(w, http.StatusPreconditionFailed, new_error_message(ERROR_BUSY, "all slots are busy", nil))
+        o.metrics.increment(METRIC_JOBS_REFUSED, label("reason", "busy"))
+        log_error("Could not make busy", nil, "work_path", work_path)
+        return
+    }
+
+    job_id, err:=get_random_u64()
+    if err!=nil{
+        log_error("Error generating job id", err)
+    }
+
+    job:=Job{
+        id: fmt.Sprintf("%016x", job_id),
+        slot: slot,
+        host: o.host,
+        signer: o.signer,
+        work_path: work_path,
+        base_env: o.base_env,
+        env: command_message.Env,
+        limits: effective_limits(command_message.Limits, o.config.Default_limits, o.config.Max_limits),
+        scheduling: scheduling,
+        cpus: o.config.slot_cpus(slot),
+        credential: o.credential,
+        cgroup_root: o.cgroup_root,
+        isolate: isolate,
+        toolchain_paths: o.config.Toolchain_paths,
+        resources: resources,
+        outputs: command_message.Outputs,
+        inputs: command_message.Inputs,
+        artifact_path: o.config.Artifact_path,
+        artifact_client: o.artifact_client,
+    }
+    if len(o.config.Job_log_path)!=0{
+        job.log_path=filepath.Join(o.config.Job_log_path, job.id+".log")
+    }
+
+    o.history.set(JobStatusMessage{Job: job.id, Work_path: work_path, State: JOB_STATE_STARTING, Log_path: job.log_path})
+    o.history.set_artifact_token(job.id, artifact_token)
+    started=true
+    go job.run(o.busy, o.running, o.reservations, o.metrics, o.history)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    work_message:=WorkMessage{Job: job.id, Artifact_token: artifact_token}
+    err=json.NewEncoder(w).Encode(&work_message)
+    if err!=nil{
+        log_error("Error encoding work", err)
+    }
+    return
+}
+
+
+
+
+
+type JobControl struct{
+    nonce Nonce
+    busy Busy
+    running RunningJobs
+    metrics Metrics
+    public_key *ecdsa.PublicKey
+    action string
+}
+
+func (j JobControl) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    w.Header().Set("Content-Type", "text/plain")
+
+    control_message:=JobControlMessage{}
+    err:=json.NewDecoder(r.Body).Decode(&control_message)
+    if err!=nil{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "could not decode job control", error_details(err)))
+        log_error("Error decoding job control", err)
+        return
+    }
 
+    job_id:=r.PathValue("id")
+    string_to_sign:=func(nonce uint64) (string, error){
+        return control_message.string_to_sign(j.action, job_id, nonce), nil
+    }
+    err=check_signature(j.nonce, j.public_key, control_message.Nonce, control_message.Signature_r, control_message.Signature_s, string_to_sign)
+    if err!=nil{
+        write_signature_error(w, err, j.metrics)
+        return
+    }
+
+    if j.action==JOB_CONTROL_SUSPEND{
+        err=j.running.suspend(job_id, control_message.Keep_slot, j.busy)
+    } else{
+        err=j.running.resume(job_id, j.busy)
+    }
+
+    switch err.(type){
+    case nil:
+    case UnknownJob:
+        write_error(w, http.StatusNotFound, new_error_message(ERROR_UNKNOWN_JOB, "no such running job", error_details(nil, "job", job_id)))
+        log_error("No such running job", nil, "job", job_id)
+        return
+    case NoFreeSlot:
+        write_error(w, http.StatusPreconditionFailed, new_error_message(ERROR_BUSY, "no free slot to resume the job", error_details(nil, "job", job_id)))
+        log_error("No free slot to resume job", nil, "job", job_id)
+        return
+    default:
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not control the job", error_details(err, "job", job_id)))
+        log_error("Error controlling job", err, "job", job_id)
+        return
+    }
+
+    log_info("Job control", "job", job_id, "action", j.action)
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("ok"))
     return
@@ -247,12 +592,58 @@ func (o Worker) ServeHTTP(w http.ResponseWriter,r *http.Request){
 
 
 func main() {
+    if len(os.Args)>1 && os.Args[1]==LAUNCH_JOB_ARG{
+        err:=launch_job(os.Args[2:])
+        log_error("Error launching job", err)
+        os.Exit(127)
+    }
+    if len(os.Args)>1 && (os.Args[1]==PACK_ARTIFACTS_ARG || os.Args[1]==UNPACK_ARTIFACTS_ARG){
+        os.Exit(artifact_helper(os.Args[1], os.Args[2:]))
+    }
+
+    log_format:=flag.String("log_format", LOG_FORMAT_TEXT, "log output format: text, json or logfmt")
+    flag.Parse()
+    err:=set_log_format(*log_format)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Error:", err)
+        return
+    }
+
     public_key,err:=load_public_key()
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error loading key:", err)
+        log_error("Error loading key", err)
+        return
+    }
+
+    config, err:=load_server_config()
+    if err!=nil{
+        log_error("Error loading config", err)
+        return
+    }
+
+    credential, err:=config.job_credential()
+    if err!=nil{
+        log_error("Error resolving job user", err)
         return
     }
 
+    if jobs_run_as_root(credential){
+        if config.Allow_root{
+            log_warning("Jobs will run as root")
+        } else{
+            log_warning("Jobs would run as root and will be refused (set job_user or allow_root)")
+        }
+    }
+
+    cgroup_root:=config.Cgroup_root
+    if len(cgroup_root)!=0{
+        err=setup_cgroup_root(cgroup_root)
+        if err!=nil{
+            log_error("Error setting up cgroups, falling back to rlimits", err)
+            cgroup_root=""
+        }
+    }
+
     mux:=http.NewServeMux()
     server:=&http.Server{
         Addr: ":4753",
@@ -264,22 +655,102 @@ func main() {
 
     first_nonce, err:=get_random_u64()
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error generating new nonce:", err)
+        log_error("Error generating new nonce", err)
     }
 
-    nonce:=Nonce{nonce: new(uint64)}
+    metrics:=new_metrics()
+    nonce:=Nonce{nonce: new(uint64), metrics: metrics}
     nonce.swap(first_nonce)
     mux.Handle("/api/get_nonce", nonce)
 
-    busy:=Busy{busy: new(int64)}
+    start_time:=time.Now()
+    running:=RunningJobs{mutex: &sync.Mutex{}, jobs: make(map[string]*RunningJob)}
+    events:=new_events()
+    desktop:=Desktop{in_use: new(int64), paused: new(int64)}
+    if config.Desktop.Mode!=DESKTOP_OFF{
+        go desktop.monitor(config.Desktop, running, events)
+    }
+
+    busy:=Busy{slots: make([]int64, config.Slots), desktop: desktop, events: events}
     mux.Handle("/api/is_busy", busy)
 
-    worker:=Worker{nonce: nonce, busy: busy, public_key: public_key}
+    capacity, err:=default_capacity(config.Capacity, config.Scratch_path)
+    if err!=nil{
+        log_error("Error getting capacity", err)
+        return
+    }
+    reservations:=Reservations{mutex: &sync.Mutex{}, reserved: &JobResources{}, capacity: capacity, scratch_path: config.Scratch_path}
+
+    info:=Info{busy: busy, reservations: reservations, config: config, start_time: start_time}
+    mux.Handle("/api/info", info)
+    mux.Handle("/api/health", Health{})
+    mux.Handle("/", NotFound{})
+
+    signer, err:=key_fingerprint(public_key)
+    if err!=nil{
+        log_error("Error getting key fingerprint", err)
+        return
+    }
+
+    host, err:=os.Hostname()
+    if err!=nil{
+        log_error("Error getting hostname", err)
+    }
+
+    history:=new_job_history(config.Artifact_path)
+    history.prune_artifacts()
+    leases:=Leases{mutex: &sync.Mutex{}, leases: make(map[string]Lease)}
+    claim:=Claim{replays: new_claim_replays(), busy: busy, leases: leases, metrics: metrics, public_key: public_key}
+
+    worker:=Worker{
+        nonce: nonce,
+        leases: leases,
+        busy: busy,
+        running: running,
+        history: history,
+        reservations: reservations,
+        metrics: metrics,
+        public_key: public_key,
+        signer: signer,
+        host: host,
+        base_env: base_environment(config.Clean_environment, config.Environment_allowlist),
+        config: config,
+        credential: credential,
+        cgroup_root: cgroup_root,
+        artifact_client: &http.Client{Timeout: ARTIFACT_FETCH_TIMEOUT},
+    }
     mux.Handle("/api/work", worker)
 
+    suspend:=JobControl{nonce: nonce, busy: busy, running: running, metrics: metrics, public_key: public_key, action: JOB_CONTROL_SUSPEND}
+    mux.Handle("/api/jobs/{id}/suspend", suspend)
+
+    resume:=JobControl{nonce: nonce, busy: busy, running: running, metrics: metrics, public_key: public_key, action: JOB_CONTROL_RESUME}
+    mux.Handle("/api/jobs/{id}/resume", resume)
+
+    metrics_handler:=MetricsHandler{metrics: metrics, busy: busy, running: running, reservations: reservations}
+    mux.Handle("/metrics", metrics_handler)
+
+    // The routes above stay as they are for old clients, /api/v2 checks requests strictly.
+    new_command:=func() interface{}{ return &Command{} }
+    new_job_control:=func() interface{}{ return &JobControlMessage{} }
+    new_claim_request:=func() interface{}{ return &ClaimRequest{} }
+    mux.Handle("/api/v2/health", get_route(Health{}))
+    mux.Handle("/api/v2/nonce", get_route(nonce))
+    mux.Handle("/api/v2/busy", get_route(busy))
+    mux.Handle("/api/v2/info", get_route(info))
+    mux.Handle("/api/v2/events", get_route(EventStream{events: events}))
+    mux.Handle("/api/v2/claim", post_route(claim, new_claim_request, validate_claim, MAX_CLAIM_BODY_BYTES))
+    work_route:=post_route(worker, new_command, validate_command, MAX_WORK_BODY_BYTES)
+    work_route.leases, work_route.busy=&leases, busy
+    mux.Handle("/api/v2/work", work_route)
+    mux.Handle("/api/v2/jobs/{id}", get_route(JobStatus{running: running, history: history}))
+    mux.Handle("/api/v2/jobs/{id}/artifacts", get_route(Artifacts{history: history, artifact_path: config.Artifact_path}))
+    mux.Handle("/api/v2/jobs/{id}/suspend", post_route(suspend, new_job_control, validate_job_control, MAX_JOB_CONTROL_BODY_BYTES))
+    mux.Handle("/api/v2/jobs/{id}/resume", post_route(resume, new_job_control, validate_job_control, MAX_JOB_CONTROL_BODY_BYTES))
+
     err=server.ListenAndServe()
     if err!=nil{
-        fmt.Fprintln(os.Stderr, "Error:", err)
+        log_error("Error", err)
     }
-    fmt.Println("end")
+    log_info("end")
 }
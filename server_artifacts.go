@@ -0,0 +1,537 @@
+package main;
+
+import "archive/tar"
+import "crypto/subtle"
+import "crypto/rand"
+import "encoding/hex"
+import "encoding/json"
+import "compress/gzip"
+import "path/filepath"
+import "net/http"
+import "os/exec"
+import "bytes"
+import "strings"
+import "syscall"
+import "sort"
+import "time"
+import "fmt"
+import "io"
+import "os"
+
+// Fetching inputs happens while the job holds its slot, a stuck server must not hold it forever.
+const ARTIFACT_FETCH_TIMEOUT = 10*time.Minute
+
+type InvalidArtifacts struct{
+    reason string
+}
+
+func (i InvalidArtifacts) Error() string{
+    return fmt.Sprintf("InvalidArtifacts(%s)", i.reason)
+}
+
+type MissingOutput struct{
+    pattern string
+}
+
+func (m MissingOutput) Error() string{
+    return fmt.Sprintf("MissingOutput(%s)", m.pattern)
+}
+
+type ArtifactFetchFailed struct{
+    host string
+    job string
+    code int
+}
+
+func (a ArtifactFetchFailed) Error() string{
+    return fmt.Sprintf("ArtifactFetchFailed(host=%s)(job=%s)(code=%d)", a.host, a.job, a.code)
+}
+
+type IncompleteArtifacts struct{
+    host string
+    job string
+    received int64
+    expected int64
+}
+
+func (i IncompleteArtifacts) Error() string{
+    return fmt.Sprintf("IncompleteArtifacts(host=%s)(job=%s)(received=%d)(expected=%d)", i.host, i.job, i.received, i.expected)
+}
+
+type ArtifactPathNotOwned struct{
+    path string
+}
+
+func (a ArtifactPathNotOwned) Error() string{
+    return fmt.Sprintf("ArtifactPathNotOwned(%s)", a.path)
+}
+
+type UnsafeArtifactPath struct{
+    name string
+}
+
+func (u UnsafeArtifactPath) Error() string{
+    return fmt.Sprintf("UnsafeArtifactPath(%s)", u.name)
+}
+
+type ArtifactHelperFailed struct{
+    reason string
+}
+
+func (a ArtifactHelperFailed) Error() string{
+    return fmt.Sprintf("ArtifactHelperFailed(%s)", a.reason)
+}
+
+// Outputs have to stay inside the work path and inputs have to name a host, a job and its token, nothing else
+// ends up in the request they are fetched with.
+func validate_artifacts(options JobOptions) error{
+    for _,pattern:=range options.Outputs{
+        if len(pattern)==0 || filepath.IsAbs(pattern) || !is_inside(pattern){
+            return InvalidArtifacts{reason: "outputs must be relative to the work path"}
+        }
+        _, err:=filepath.Match(pattern, "")
+        if err!=nil{
+            return InvalidArtifacts{reason: "bad output pattern "+pattern}
+        }
+    }
+
+    for _,input:=range options.Inputs{
+        if len(input.Host)==0 || strings.ContainsAny(input.Host, "/?#@:% "){
+            return InvalidArtifacts{reason: "inputs must name a host"}
+        }
+        if !is_id(input.Job){
+            return InvalidArtifacts{reason: "input job must be 16 lowercase hex digits"}
+        }
+        if !is_artifact_token(input.Token){
+            return InvalidArtifacts{reason: "input token must be 32 lowercase hex digits"}
+        }
+    }
+    return nil
+}
+
+func is_inside(relative_path string) bool{
+    relative_path=filepath.Clean(relative_path)
+    return relative_path!=".." && !strings.HasPrefix(relative_path, "../")
+}
+
+// The real path of path must be the real work path or below it, so symlinks do not lead out of it.
+func is_below(work_path string, path string) bool{
+    real_work_path, err:=filepath.EvalSymlinks(work_path)
+    if err!=nil{
+        return false
+    }
+    real_path, err:=filepath.EvalSymlinks(path)
+    if err!=nil{
+        return false
+    }
+    relative_path, err:=filepath.Rel(real_work_path, real_path)
+    return err==nil && is_inside(relative_path)
+}
+
+// Job ids are published on the event stream, the token is what keeps the artifacts to the submitter and
+// whoever it passes the token on to.
+func new_artifact_token() (string, error){
+    token:=make([]byte, 16)
+    _, err:=rand.Read(token)
+    if err!=nil{
+        return "", err
+    }
+    return hex.EncodeToString(token), nil
+}
+
+func is_artifact_token(value string) bool{
+    if len(value)!=32{
+        return false
+    }
+    _, err:=hex.DecodeString(value)
+    return err==nil && strings.ToLower(value)==value
+}
+
+// Archives are handed to anyone with the job's token, so the directory has to be the server's alone: created
+// 0700 if missing, and refused if it exists but is not a directory owned by the server's user.
+func prepare_artifact_path(artifact_path string) error{
+    err:=os.MkdirAll(artifact_path, 0700)
+    if err!=nil{
+        return err
+    }
+
+    file_info, err:=os.Lstat(artifact_path)
+    if err!=nil{
+        return err
+    }
+    stat, ok:=file_info.Sys().(*syscall.Stat_t)
+    if !file_info.IsDir() || !ok || int(stat.Uid)!=os.Geteuid(){
+        return ArtifactPathNotOwned{path: artifact_path}
+    }
+    return nil
+}
+
+func artifact_archive_path(artifact_path string, job_id string) string{
+    return filepath.Join(artifact_path, job_id+".tar.gz")
+}
+
+const PACK_ARTIFACTS_ARG = "pack_artifacts"
+const UNPACK_ARTIFACTS_ARG = "unpack_artifacts"
+
+// What the helper reports on stderr when it is done.
+type ArtifactHelperResult struct{
+    Matched []string `json:"matched,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+// The work path is the job's to change, so whatever reads or writes it on the job's behalf is the server
+// re-executed as a helper with the job's credential. Symlinks the job leaves behind then only lead where
+// the job could go itself.
+func artifact_helper_command(credential *syscall.Credential, arg string, args ...string) *exec.Cmd{
+    cmd:=exec.Command("/proc/self/exe", append([]string{arg}, args...)...)
+    cmd.SysProcAttr=&syscall.SysProcAttr{Credential: credential}
+    return cmd
+}
+
+func run_artifact_helper(cmd *exec.Cmd) ([]string, error){
+    var stderr bytes.Buffer
+    cmd.Stderr=&stderr
+    run_err:=cmd.Run()
+
+    var result ArtifactHelperResult
+    err:=json.Unmarshal(stderr.Bytes(), &result)
+    switch{
+    case err!=nil && run_err!=nil:
+        return nil, ArtifactHelperFailed{reason: fmt.Sprintf("%v: %s", run_err, strings.TrimSpace(stderr.String()))}
+    case err!=nil:
+        return nil, err
+    case len(result.Error)!=0:
+        return nil, ArtifactHelperFailed{reason: result.Error}
+    }
+    return result.Matched, run_err
+}
+
+// Runs in the helper process, returns its exit code.
+func artifact_helper(arg string, args []string) int{
+    var result ArtifactHelperResult
+    var err error
+    switch{
+    case arg==PACK_ARTIFACTS_ARG && len(args)>=1:
+        result.Matched, err=pack_artifacts(args[0], args[1:], os.Stdout)
+    case arg==UNPACK_ARTIFACTS_ARG && len(args)==1:
+        err=unpack_artifacts(os.Stdin, args[0])
+    default:
+        err=InvalidArtifacts{reason: "malformed helper arguments"}
+    }
+
+    exit_code:=0
+    if err!=nil{
+        result.Error=err.Error()
+        exit_code=1
+    }
+    json.NewEncoder(os.Stderr).Encode(&result)
+    return exit_code
+}
+
+// Packs everything the outputs match into one archive and returns the matches, relative to the work path.
+// The work path belongs to the job, so the packing is done by a helper running as the job's user.
+func collect_artifacts(work_path string, outputs []string, archive_path string, credential *syscall.Credential) ([]string, error){
+    err:=os.MkdirAll(filepath.Dir(archive_path), 0700)
+    if err!=nil{
+        return nil, err
+    }
+
+    temporary_path:=archive_path+".tmp"
+    f, err:=os.OpenFile(temporary_path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+    if err!=nil{
+        return nil, err
+    }
+    defer os.Remove(temporary_path)
+    defer f.Close()
+
+    cmd:=artifact_helper_command(credential, PACK_ARTIFACTS_ARG, append([]string{work_path}, outputs...)...)
+    cmd.Stdout=f
+    matched, err:=run_artifact_helper(cmd)
+    if err==nil{
+        err=f.Close()
+    }
+    if err==nil{
+        err=os.Rename(temporary_path, archive_path)
+    }
+    if err!=nil{
+        return nil, err
+    }
+    return matched, nil
+}
+
+// Runs in the helper. Every pattern has to match something. Only directories and regular files are packed.
+func pack_artifacts(work_path string, outputs []string, writer io.Writer) ([]string, error){
+    gzip_writer:=gzip.NewWriter(writer)
+    tar_writer:=tar.NewWriter(gzip_writer)
+    packed:=make(map[string]bool)
+    matched:=make([]string, 0, len(outputs))
+    for _,pattern:=range outputs{
+        matches, err:=filepath.Glob(filepath.Join(work_path, pattern))
+        if err!=nil{
+            return nil, err
+        }
+        if len(matches)==0{
+            return nil, MissingOutput{pattern: pattern}
+        }
+
+        for _,match:=range matches{
+            if !is_below(work_path, match){
+                return nil, UnsafeArtifactPath{name: match}
+            }
+
+            relative_match, err:=filepath.Rel(work_path, match)
+            if err!=nil{
+                return nil, err
+            }
+            matched=append(matched, relative_match)
+
+            err=filepath.Walk(match, func(path string, file_info os.FileInfo, err error) error{
+                if err!=nil{
+                    return err
+                }
+
+                name, err:=filepath.Rel(work_path, path)
+                if err!=nil || packed[name] || !(file_info.IsDir() || file_info.Mode().IsRegular()){
+                    return err
+                }
+                packed[name]=true
+                return add_to_archive(tar_writer, path, name, file_info)
+            })
+            if err!=nil{
+                return nil, err
+            }
+        }
+    }
+
+    err:=tar_writer.Close()
+    if err==nil{
+        err=gzip_writer.Close()
+    }
+    if err!=nil{
+        return nil, err
+    }
+
+    sort.Strings(matched)
+    return matched, nil
+}
+
+// The file is packed only if it is still the one Walk found, not something swapped in since.
+func add_to_archive(tar_writer *tar.Writer, path string, name string, file_info os.FileInfo) error{
+    header, err:=tar.FileInfoHeader(file_info, "")
+    if err!=nil{
+        return err
+    }
+    header.Name=filepath.ToSlash(name)
+    header.Uid, header.Gid, header.Uname, header.Gname=0, 0, "", ""
+
+    if file_info.IsDir(){
+        return tar_writer.WriteHeader(header)
+    }
+
+    f, err:=os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+    if err!=nil{
+        return err
+    }
+    defer f.Close()
+
+    opened_info, err:=f.Stat()
+    if err!=nil{
+        return err
+    }
+    if !os.SameFile(file_info, opened_info){
+        return UnsafeArtifactPath{name: name}
+    }
+
+    err=tar_writer.WriteHeader(header)
+    if err!=nil{
+        return err
+    }
+    _, err=io.Copy(tar_writer, f)
+    return err
+}
+
+// Unpacks the artifacts of another job into the work path. The server fetches them, the unpacking is done
+// by a helper running as the job's user, so what it creates is the job's and it writes nowhere the job
+// could not.
+func fetch_artifacts(client *http.Client, source ArtifactSource, work_path string, credential *syscall.Credential) error{
+    request, err:=http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:4753/api/v2/jobs/%s/artifacts", source.Host, source.Job), nil)
+    if err!=nil{
+        return err
+    }
+    request.Header.Set("Authorization", "Bearer "+source.Token)
+
+    response, err:=client.Do(request)
+    if err!=nil{
+        return err
+    }
+    defer response.Body.Close()
+
+    if response.StatusCode!=http.StatusOK{
+        return ArtifactFetchFailed{host: source.Host, job: source.Job, code: response.StatusCode}
+    }
+
+    body:=&CountingReader{reader: response.Body}
+    cmd:=artifact_helper_command(credential, UNPACK_ARTIFACTS_ARG, work_path)
+    cmd.Stdin=body
+    _, err=run_artifact_helper(cmd)
+    if err!=nil{
+        return err
+    }
+    return check_received(body, response.ContentLength, source)
+}
+
+// Runs in the helper. Names that would lead out of the work path, and symlinks in the way, stop it.
+func unpack_artifacts(reader io.Reader, work_path string) error{
+    gzip_reader, err:=gzip.NewReader(reader)
+    if err!=nil{
+        return err
+    }
+    tar_reader:=tar.NewReader(gzip_reader)
+    for{
+        header, err:=tar_reader.Next()
+        if err==io.EOF{
+            // The server counts what is left of the body.
+            _, err=io.Copy(io.Discard, reader)
+            return err
+        }
+        if err!=nil{
+            return err
+        }
+
+        name:=filepath.FromSlash(header.Name)
+        if filepath.IsAbs(name) || !is_inside(name){
+            return UnsafeArtifactPath{name: header.Name}
+        }
+        target:=filepath.Join(work_path, name)
+
+        switch header.Typeflag{
+        case tar.TypeDir:
+            err=make_directories(work_path, target)
+        case tar.TypeReg:
+            err=make_directories(work_path, filepath.Dir(target))
+            if err==nil{
+                err=extract_file(tar_reader, target, os.FileMode(header.Mode)&0755)
+            }
+        }
+        if err!=nil{
+            return err
+        }
+    }
+}
+
+type CountingReader struct{
+    reader io.Reader
+    count int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error){
+    n, err:=c.reader.Read(p)
+    c.count+=int64(n)
+    return n, err
+}
+
+// The archive can end before the body does, what is left is read so a short body is noticed.
+func check_received(body *CountingReader, content_length int64, source ArtifactSource) error{
+    _, err:=io.Copy(io.Discard, body)
+    if err!=nil{
+        return err
+    }
+    if content_length>=0 && body.count!=content_length{
+        return IncompleteArtifacts{host: source.Host, job: source.Job, received: body.count, expected: content_length}
+    }
+    return nil
+}
+
+// Creates directory and whatever is missing above it, as long as what already exists is in the work path.
+func make_directories(work_path string, directory string) error{
+    missing:=[]string{}
+    existing:=directory
+    for{
+        _, err:=os.Lstat(existing)
+        if err==nil{
+            break
+        }
+        if !os.IsNotExist(err){
+            return err
+        }
+        missing=append(missing, existing)
+        existing=filepath.Dir(existing)
+    }
+    if !is_below(work_path, existing){
+        return UnsafeArtifactPath{name: directory}
+    }
+
+    for i:=len(missing)-1;i>=0;i--{
+        err:=os.Mkdir(missing[i], 0755)
+        if err!=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+func extract_file(reader io.Reader, target string, mode os.FileMode) error{
+    f, err:=os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+    if err!=nil{
+        return err
+    }
+
+    _, err=io.Copy(f, reader)
+    close_err:=f.Close()
+    if err==nil{
+        err=close_err
+    }
+    return err
+}
+
+
+
+
+// Only with the token the job's submitter got, as a bearer token. Servers fetch artifacts from each other
+// and have no key to sign with, the token travels in the signed inputs of the dependent job.
+type Artifacts struct{
+    history JobHistory
+    artifact_path string
+}
+
+func (a Artifacts) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    job_id:=r.PathValue("id")
+    status, ok:=a.history.get(job_id)
+    if !ok{
+        write_error(w, http.StatusNotFound, new_error_message(ERROR_UNKNOWN_JOB, "no such job, or it finished too long ago", error_details(nil, "job", job_id)))
+        return
+    }
+    token, ok:=a.history.artifact_token(job_id)
+    if !ok || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token))!=1{
+        write_error(w, http.StatusUnauthorized, new_error_message(ERROR_UNAUTHORIZED, "missing or wrong artifact token", error_details(nil, "job", job_id)))
+        return
+    }
+    if len(status.Artifacts)==0{
+        write_error(w, http.StatusNotFound, new_error_message(ERROR_NOT_FOUND, "job has no artifacts", error_details(nil, "job", job_id)))
+        return
+    }
+
+    f, err:=os.Open(artifact_archive_path(a.artifact_path, job_id))
+    if err!=nil{
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not open artifacts", nil))
+        log_error("Error opening artifacts", err, "job", job_id)
+        return
+    }
+    defer f.Close()
+
+    file_info, err:=f.Stat()
+    if err!=nil{
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not open artifacts", nil))
+        log_error("Error opening artifacts", err, "job", job_id)
+        return
+    }
+
+    // Archives can take longer to send than the server's write timeout allows.
+    err=http.NewResponseController(w).SetWriteDeadline(time.Time{})
+    if err!=nil{
+        log_error("Error clearing write deadline", err, "job", job_id)
+    }
+
+    w.Header().Set("Content-Type", "application/gzip")
+    http.ServeContent(w, r, "", file_info.ModTime(), f)
+}
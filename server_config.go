@@ -0,0 +1,212 @@
+package main;
+
+import "encoding/json"
+import "path/filepath"
+import "os/user"
+import "strconv"
+import "syscall"
+import "fmt"
+import "os"
+
+type ServerConfig struct{
+    Job_user string `json:"job_user"`
+    Job_group string `json:"job_group"`
+    Allow_root bool `json:"allow_root"`
+    Cgroup_root string `json:"cgroup_root"`
+    Default_limits JobLimits `json:"default_limits"`
+    Max_limits JobLimits `json:"max_limits"`
+    Isolation string `json:"isolation"`
+    Toolchain_paths []string `json:"toolchain_paths"`
+    Slots int `json:"slots"`
+    Clean_environment bool `json:"clean_environment"`
+    Environment_allowlist []string `json:"environment_allowlist"`
+    Scheduling JobScheduling `json:"scheduling"`
+    Slot_cpus [][]int `json:"slot_cpus"`
+    Desktop DesktopConfig `json:"desktop"`
+    Labels map[string]string `json:"labels"`
+    Scratch_path string `json:"scratch_path"`
+    Capacity JobResources `json:"capacity"`
+    Job_log_path string `json:"job_log_path"`
+    Artifact_path string `json:"artifact_path"`
+}
+
+type InvalidServerConfig struct{
+    reason string
+}
+
+func (i InvalidServerConfig) Error() string{
+    return fmt.Sprintf("InvalidServerConfig(%s)", i.reason)
+}
+
+// The config file is optional, a missing file means default values.
+func load_server_config() (ServerConfig, error){
+    var config ServerConfig
+    f,err:=os.Open("server_config.json")
+    if err==nil{
+        defer f.Close()
+        err=json.NewDecoder(f).Decode(&config)
+        if err!=nil{
+            return config, err
+        }
+    } else if !os.IsNotExist(err){
+        return config, err
+    }
+
+    switch config.Isolation{
+    case "":
+        config.Isolation=ISOLATION_NEVER
+    case ISOLATION_NEVER, ISOLATION_ALLOWED, ISOLATION_ALWAYS:
+    default:
+        return config, InvalidServerConfig{reason: "unknown isolation "+config.Isolation}
+    }
+
+    if len(config.Toolchain_paths)==0{
+        config.Toolchain_paths=DEFAULT_TOOLCHAIN_PATHS
+    }
+
+    if config.Slots<0{
+        return config, InvalidServerConfig{reason: "negative slots"}
+    }
+    if config.Slots==0{
+        config.Slots=1
+    }
+
+    err=validate_scheduling(config.Scheduling)
+    if err!=nil{
+        return config, InvalidServerConfig{reason: "invalid scheduling"}
+    }
+
+    for _,cpus:=range config.Slot_cpus{
+        err=validate_cpus(cpus)
+        if err!=nil{
+            return config, InvalidServerConfig{reason: "invalid slot_cpus"}
+        }
+    }
+
+    switch config.Desktop.Mode{
+    case "":
+        config.Desktop.Mode=DESKTOP_OFF
+    case DESKTOP_OFF, DESKTOP_REFUSE, DESKTOP_PAUSE:
+    default:
+        return config, InvalidServerConfig{reason: "unknown desktop mode "+config.Desktop.Mode}
+    }
+
+    if config.Desktop.Check_interval_seconds<=0{
+        config.Desktop.Check_interval_seconds=10
+    }
+    if config.Desktop.Idle_seconds<=0{
+        config.Desktop.Idle_seconds=300
+    }
+
+    if config.Labels==nil{
+        config.Labels=make(map[string]string)
+    }
+
+    if len(config.Scratch_path)==0{
+        config.Scratch_path="/tmp"
+    }
+
+    // Without a job log path, job output goes to the server's own as it always did.
+    if len(config.Job_log_path)!=0{
+        if !filepath.IsAbs(config.Job_log_path){
+            return config, InvalidServerConfig{reason: "job_log_path must be absolute"}
+        }
+        err=os.MkdirAll(config.Job_log_path, 0750)
+        if err!=nil{
+            return config, err
+        }
+    }
+
+    // Not under the scratch path, anyone can create directories in /tmp before the server does.
+    if len(config.Artifact_path)==0{
+        cache_path, err:=os.UserCacheDir()
+        if err!=nil{
+            return config, InvalidServerConfig{reason: "no cache directory for artifacts, set artifact_path"}
+        }
+        config.Artifact_path=filepath.Join(cache_path, "work_distributer", "artifacts")
+    }
+    if !filepath.IsAbs(config.Artifact_path){
+        return config, InvalidServerConfig{reason: "artifact_path must be absolute"}
+    }
+    err=prepare_artifact_path(config.Artifact_path)
+    if err!=nil{
+        return config, err
+    }
+
+    if config.Environment_allowlist==nil{
+        config.Environment_allowlist=DEFAULT_ENVIRONMENT_ALLOWLIST
+    }
+
+    return config, nil
+}
+
+func (c ServerConfig) slot_cpus(slot int) []int{
+    if slot>=len(c.Slot_cpus){
+        return nil
+    }
+    return c.Slot_cpus[slot]
+}
+
+func lookup_uid(name string) (*user.User, error){
+    if _,err:=strconv.ParseUint(name, 10, 32); err==nil{
+        return user.LookupId(name)
+    }
+    return user.Lookup(name)
+}
+
+func lookup_gid(name string) (uint32, error){
+    if gid,err:=strconv.ParseUint(name, 10, 32); err==nil{
+        return uint32(gid), nil
+    }
+
+    group, err:=user.LookupGroup(name)
+    if err!=nil{
+        return 0, err
+    }
+
+    gid, err:=strconv.ParseUint(group.Gid, 10, 32)
+    return uint32(gid), err
+}
+
+// Returns the credential jobs should run with, or nil if they run as the server's own user.
+func (c ServerConfig) job_credential() (*syscall.Credential, error){
+    if len(c.Job_user)==0{
+        if len(c.Job_group)!=0{
+            return nil, InvalidServerConfig{reason: "job_group without job_user"}
+        }
+        return nil, nil
+    }
+
+    job_user, err:=lookup_uid(c.Job_user)
+    if err!=nil{
+        return nil, err
+    }
+
+    uid, err:=strconv.ParseUint(job_user.Uid, 10, 32)
+    if err!=nil{
+        return nil, err
+    }
+
+    gid, err:=strconv.ParseUint(job_user.Gid, 10, 32)
+    if err!=nil{
+        return nil, err
+    }
+
+    credential:=&syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}
+    if len(c.Job_group)!=0{
+        credential.Gid, err=lookup_gid(c.Job_group)
+        if err!=nil{
+            return nil, err
+        }
+    }
+
+    return credential, nil
+}
+
+// Jobs run as root if they are given uid 0 or if they inherit a root server's credentials.
+func jobs_run_as_root(credential *syscall.Credential) bool{
+    if credential==nil{
+        return os.Geteuid()==0
+    }
+    return credential.Uid==0
+}
@@ -0,0 +1,415 @@
+package main;
+
+import "encoding/binary"
+import "sync/atomic"
+import "io/ioutil"
+import "os/exec"
+import "strconv"
+import "strings"
+import "syscall"
+import "bytes"
+import "math"
+import "time"
+import "fmt"
+import "os"
+
+const DESKTOP_OFF = "off"
+const DESKTOP_REFUSE = "refuse"
+const DESKTOP_PAUSE = "pause"
+
+const UTMP_PATH = "/var/run/utmp"
+const UTMP_RECORD_SIZE = 384
+const UTMP_USER_PROCESS = 7
+const INPUT_DEVICES_PATH = "/dev/input"
+
+// Mode "refuse" only stops taking new jobs while someone uses the machine, "pause" also stops the running ones.
+type DesktopConfig struct{
+    Mode string `json:"mode"`
+    Check_interval_seconds int `json:"check_interval_seconds"`
+    Idle_seconds int `json:"idle_seconds"`
+    Count_remote_sessions bool `json:"count_remote_sessions"`
+    Max_non_job_cpus float64 `json:"max_non_job_cpus"`
+}
+
+type Desktop struct{
+    in_use *int64
+    paused *int64
+}
+
+func (d Desktop) is_in_use() bool{
+    return atomic.LoadInt64(d.in_use)!=0
+}
+
+func (d Desktop) is_paused() bool{
+    return atomic.LoadInt64(d.paused)!=0
+}
+
+
+
+
+
+
+type utmp_session struct{
+    line string
+    host string
+}
+
+func c_string(b []byte) string{
+    end:=bytes.IndexByte(b, 0)
+    if end<0{
+        end=len(b)
+    }
+    return string(b[:end])
+}
+
+func read_utmp_sessions() ([]utmp_session, error){
+    content, err:=ioutil.ReadFile(UTMP_PATH)
+    if err!=nil{
+        return nil, err
+    }
+
+    sessions:=make([]utmp_session, 0, 4)
+    for offset:=0;offset+UTMP_RECORD_SIZE<=len(content);offset+=UTMP_RECORD_SIZE{
+        record:=content[offset:offset+UTMP_RECORD_SIZE]
+        if binary.LittleEndian.Uint16(record[0:2])!=UTMP_USER_PROCESS{
+            continue
+        }
+        sessions=append(sessions, utmp_session{line: c_string(record[8:40]), host: c_string(record[76:332])})
+    }
+
+    return sessions, nil
+}
+
+// Like w, a terminal's access time is the last time someone typed into it.
+func tty_idle_time(line string, now time.Time) (time.Duration, bool){
+    var stat syscall.Stat_t
+    err:=syscall.Stat("/dev/"+line, &stat)
+    if err!=nil{
+        return 0, false
+    }
+    return now.Sub(time.Unix(stat.Atim.Sec, stat.Atim.Nsec)), true
+}
+
+// Time since the newest access to a keyboard, mouse or other input device, which is what graphical sessions
+// read from. False if there are none to look at.
+func input_idle_time(now time.Time) (time.Duration, bool){
+    entries, err:=ioutil.ReadDir(INPUT_DEVICES_PATH)
+    if err!=nil{
+        return 0, false
+    }
+
+    newest:=time.Time{}
+    for _,entry:=range entries{
+        var stat syscall.Stat_t
+        if syscall.Stat(INPUT_DEVICES_PATH+"/"+entry.Name(), &stat)!=nil || stat.Mode&syscall.S_IFMT!=syscall.S_IFCHR{
+            continue
+        }
+        accessed:=time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+        if accessed.After(newest){
+            newest=accessed
+        }
+    }
+    if newest.IsZero(){
+        return 0, false
+    }
+    return now.Sub(newest), true
+}
+
+// Text sessions are idle for as long as their terminal is. Local sessions may just as well be graphical, on
+// ":0" or on a ttyN line, so for them input devices count too. A session nothing is known about is idle.
+func (s utmp_session) idle_time(now time.Time, input_idle time.Duration, has_input bool) (time.Duration, bool){
+    idle, ok:=time.Duration(0), false
+    if !strings.HasPrefix(s.line, ":"){
+        idle, ok=tty_idle_time(s.line, now)
+    }
+    if !s.is_remote() && has_input && (!ok || input_idle<idle){
+        idle, ok=input_idle, true
+    }
+    return idle, ok
+}
+
+func (s utmp_session) is_remote() bool{
+    return len(s.host)!=0 && !strings.HasPrefix(s.host, ":")
+}
+
+// A login session and how long nobody used it.
+type desktop_session struct{
+    name string
+    remote bool
+    idle time.Duration
+}
+
+// Asks logind, which knows graphical sessions' idle state from the desktop itself and text sessions' from
+// their terminals. Fails where logind is not running.
+func read_logind_sessions(now time.Time) ([]desktop_session, error){
+    output, err:=exec.Command("loginctl", "list-sessions", "--no-legend").Output()
+    if err!=nil{
+        return nil, err
+    }
+
+    arguments:=[]string{"show-session"}
+    for _,line:=range strings.Split(string(output), "\n"){
+        fields:=strings.Fields(line)
+        if len(fields)!=0{
+            arguments=append(arguments, fields[0])
+        }
+    }
+    if len(arguments)==1{
+        return nil, nil
+    }
+    arguments=append(arguments, "-p", "Id", "-p", "Class", "-p", "Remote", "-p", "IdleHint", "-p", "IdleSinceHint")
+
+    output, err=exec.Command("loginctl", arguments...).Output()
+    if err!=nil{
+        return nil, err
+    }
+
+    sessions:=make([]desktop_session, 0, len(arguments))
+    for _,block:=range strings.Split(string(output), "\n\n"){
+        properties:=make(map[string]string)
+        for _,line:=range strings.Split(block, "\n"){
+            name, value, ok:=strings.Cut(line, "=")
+            if ok{
+                properties[name]=value
+            }
+        }
+        if properties["Class"]!="user"{
+            continue
+        }
+
+        session:=desktop_session{name: "session "+properties["Id"], remote: properties["Remote"]=="yes"}
+        if properties["IdleHint"]=="yes"{
+            // Idle since an unknown time counts as idle for good.
+            session.idle=time.Duration(math.MaxInt64)
+            idle_since, err:=strconv.ParseInt(properties["IdleSinceHint"], 10, 64)
+            if err==nil && idle_since>0{
+                session.idle=now.Sub(time.UnixMicro(idle_since))
+            }
+        }
+        sessions=append(sessions, session)
+    }
+    return sessions, nil
+}
+
+// From logind if it runs, otherwise from utmp, terminals and input devices.
+func read_desktop_sessions(now time.Time) ([]desktop_session, error){
+    sessions, err:=read_logind_sessions(now)
+    if err==nil{
+        return sessions, nil
+    }
+
+    utmp_sessions, err:=read_utmp_sessions()
+    if err!=nil{
+        return nil, err
+    }
+
+    input_idle, has_input:=input_idle_time(now)
+    sessions=make([]desktop_session, 0, len(utmp_sessions))
+    for _,utmp_session:=range utmp_sessions{
+        idle, ok:=utmp_session.idle_time(now, input_idle, has_input)
+        if ok{
+            sessions=append(sessions, desktop_session{name: utmp_session.line, remote: utmp_session.is_remote(), idle: idle})
+        }
+    }
+    return sessions, nil
+}
+
+
+
+
+
+
+type cpu_sample struct{
+    busy uint64
+    total uint64
+    cpus int
+    job_ticks map[int]uint64
+}
+
+func read_cpu_ticks() (uint64, uint64, int, error){
+    content, err:=ioutil.ReadFile("/proc/stat")
+    if err!=nil{
+        return 0, 0, 0, err
+    }
+
+    busy, total, cpus:=uint64(0), uint64(0), 0
+    for _,line:=range strings.Split(string(content), "\n"){
+        fields:=strings.Fields(line)
+        if len(fields)<5 || !strings.HasPrefix(fields[0], "cpu"){
+            continue
+        }
+        if fields[0]!="cpu"{
+            cpus++
+            continue
+        }
+
+        for i,field:=range fields[1:]{
+            ticks, err:=strconv.ParseUint(field, 10, 64)
+            if err!=nil{
+                return 0, 0, 0, err
+            }
+            total+=ticks
+            if i!=3 && i!=4{ // idle and iowait
+                busy+=ticks
+            }
+        }
+    }
+
+    return busy, total, cpus, nil
+}
+
+// Cpu ticks of every process group, children's ticks are included once they are reaped.
+func read_process_group_ticks() map[int]uint64{
+    ticks:=make(map[int]uint64)
+    entries, err:=ioutil.ReadDir("/proc")
+    if err!=nil{
+        return ticks
+    }
+
+    for _,entry:=range entries{
+        if _,err:=strconv.Atoi(entry.Name()); err!=nil{
+            continue
+        }
+
+        content, err:=ioutil.ReadFile("/proc/"+entry.Name()+"/stat")
+        if err!=nil{
+            continue
+        }
+
+        // The command name may contain spaces, the fields start after its closing parenthesis
+        end_of_name:=bytes.LastIndexByte(content, ')')
+        if end_of_name<0{
+            continue
+        }
+        fields:=strings.Fields(string(content[end_of_name+1:]))
+        if len(fields)<15{
+            continue
+        }
+
+        pgid, err:=strconv.Atoi(fields[2])
+        if err!=nil{
+            continue
+        }
+        for _,field:=range fields[11:15]{ // utime, stime, cutime, cstime
+            value, err:=strconv.ParseUint(field, 10, 64)
+            if err==nil{
+                ticks[pgid]+=value
+            }
+        }
+    }
+
+    return ticks
+}
+
+func take_cpu_sample(running RunningJobs) (cpu_sample, error){
+    busy, total, cpus, err:=read_cpu_ticks()
+    if err!=nil{
+        return cpu_sample{}, err
+    }
+
+    group_ticks:=read_process_group_ticks()
+    job_ticks:=make(map[int]uint64)
+    running.for_each(func(job *RunningJob){
+        job_ticks[job.pid]=group_ticks[job.pid]
+    })
+
+    return cpu_sample{busy: busy, total: total, cpus: cpus, job_ticks: job_ticks}, nil
+}
+
+// How many cpus worth of work something other than our jobs did between the two samples.
+func non_job_cpus(previous cpu_sample, current cpu_sample) float64{
+    if current.total<=previous.total || current.busy<previous.busy{
+        return 0
+    }
+
+    job_ticks:=uint64(0)
+    for pid,ticks:=range current.job_ticks{
+        previous_ticks, ok:=previous.job_ticks[pid]
+        if ok && ticks>previous_ticks{
+            job_ticks+=ticks-previous_ticks
+        }
+    }
+
+    busy:=current.busy-previous.busy
+    if job_ticks>=busy{
+        return 0
+    }
+
+    return float64(busy-job_ticks)/float64(current.total-previous.total)*float64(current.cpus)
+}
+
+
+
+
+
+
+// Returns why the machine is in use, or an empty string if it is not.
+func (d Desktop) check_in_use(config DesktopConfig, previous cpu_sample, current cpu_sample) string{
+    now:=time.Now()
+    sessions, err:=read_desktop_sessions(now)
+    if err!=nil && !os.IsNotExist(err){
+        log_error("Error reading sessions", err)
+    }
+
+    for _,session:=range sessions{
+        if session.remote && !config.Count_remote_sessions{
+            continue
+        }
+        if session.idle<time.Duration(config.Idle_seconds)*time.Second{
+            return "session on "+session.name
+        }
+    }
+
+    if config.Max_non_job_cpus>0 && previous.total!=0{
+        cpus:=non_job_cpus(previous, current)
+        if cpus>config.Max_non_job_cpus{
+            return fmt.Sprintf("non job load of %.2f cpus", cpus)
+        }
+    }
+
+    return ""
+}
+
+func (d Desktop) set_jobs_paused(running RunningJobs, paused bool){
+    running.for_each(func(job *RunningJob){
+        err:=job.set_paused(paused)
+        if err!=nil{
+            log_error("Error pausing or continuing job", err, "job", job.id)
+        }
+    })
+}
+
+func (d Desktop) monitor(config DesktopConfig, running RunningJobs, events Events){
+    var previous cpu_sample
+    for{
+        current, err:=take_cpu_sample(running)
+        if err!=nil{
+            log_error("Error reading cpu usage", err)
+        }
+
+        reason:=d.check_in_use(config, previous, current)
+        previous=current
+
+        if len(reason)!=0 && !d.is_in_use(){
+            log_info("Machine is in use", "reason", reason)
+            atomic.StoreInt64(d.in_use, 1)
+            events.publish(EventMessage{Type: EVENT_DRAIN, Draining: true})
+        } else if len(reason)==0 && d.is_in_use(){
+            log_info("Machine is idle again")
+            atomic.StoreInt64(d.in_use, 0)
+            events.publish(EventMessage{Type: EVENT_DRAIN, Draining: false})
+        }
+
+        // Stopping is repeated on every check to catch jobs that started just as the machine came into use
+        if config.Mode==DESKTOP_PAUSE && (d.is_in_use() || d.is_paused()){
+            d.set_jobs_paused(running, d.is_in_use())
+            if d.is_in_use(){
+                atomic.StoreInt64(d.paused, 1)
+            } else{
+                atomic.StoreInt64(d.paused, 0)
+            }
+        }
+
+        time.Sleep(time.Duration(config.Check_interval_seconds)*time.Second)
+    }
+}
@@ -0,0 +1,101 @@
+package main;
+
+import "encoding/json"
+import "net/http"
+import "sync"
+import "time"
+import "fmt"
+
+const EVENT_KEEPALIVE_INTERVAL = 15*time.Second
+
+// Events that do not fit in a subscriber's buffer are dropped for it, a slow client must not hold the server up.
+const EVENT_BUFFER = 64
+
+type Events struct{
+    mutex *sync.Mutex
+    subscribers map[chan EventMessage]bool
+}
+
+func new_events() Events{
+    return Events{mutex: &sync.Mutex{}, subscribers: make(map[chan EventMessage]bool)}
+}
+
+func (e Events) subscribe() chan EventMessage{
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+
+    subscriber:=make(chan EventMessage, EVENT_BUFFER)
+    e.subscribers[subscriber]=true
+    return subscriber
+}
+
+func (e Events) unsubscribe(subscriber chan EventMessage){
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    delete(e.subscribers, subscriber)
+}
+
+func (e Events) publish(event EventMessage){
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+
+    for subscriber:=range e.subscribers{
+        select{
+        case subscriber<-event:
+        default:
+        }
+    }
+}
+
+
+
+
+// Server-Sent Events, one "event: <type>" and "data: <EventMessage>" per event, with comments as keepalives.
+type EventStream struct{
+    events Events
+}
+
+func (e EventStream) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    controller:=http.NewResponseController(w)
+
+    // The server's write timeout is meant for short answers, not for a stream.
+    err:=controller.SetWriteDeadline(time.Time{})
+    if err!=nil{
+        log_error("Error extending write deadline", err)
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not open event stream", error_details(err)))
+        return
+    }
+
+    subscriber:=e.events.subscribe()
+    defer e.events.unsubscribe(subscriber)
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+    controller.Flush()
+
+    keepalive:=time.NewTicker(EVENT_KEEPALIVE_INTERVAL)
+    defer keepalive.Stop()
+
+    for{
+        select{
+        case <-r.Context().Done():
+            return
+        case <-keepalive.C:
+            _, err=fmt.Fprint(w, ": keepalive\n\n")
+        case event:=<-subscriber:
+            var event_in_bytes []byte
+            event_in_bytes, err=json.Marshal(&event)
+            if err==nil{
+                _, err=fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event_in_bytes)
+            }
+        }
+
+        if err==nil{
+            err=controller.Flush()
+        }
+        if err!=nil{
+            return
+        }
+    }
+}
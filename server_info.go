@@ -0,0 +1,170 @@
+package main;
+
+import "encoding/json"
+import "io/ioutil"
+import "net/http"
+import "strconv"
+import "strings"
+import "syscall"
+import "runtime"
+import "time"
+
+const SERVER_VERSION = "1.10.0"
+
+var SERVER_FEATURES = []string{FEATURE_JOB_OPTIONS, FEATURE_INFO, FEATURE_JOB_CONTROL, FEATURE_METRICS, FEATURE_STRUCTURED_ERRORS, FEATURE_API_V2, FEATURE_CLAIM, FEATURE_EVENTS, FEATURE_JOB_STATUS, FEATURE_ARTIFACTS}
+
+func read_load_averages() ([3]float64, error){
+    var load_averages [3]float64
+    content, err:=ioutil.ReadFile("/proc/loadavg")
+    if err!=nil{
+        return load_averages, err
+    }
+
+    fields:=strings.Fields(string(content))
+    if len(fields)<3{
+        return load_averages, IncompleteRead{}
+    }
+
+    for i:=range load_averages{
+        load_averages[i], err=strconv.ParseFloat(fields[i], 64)
+        if err!=nil{
+            return load_averages, err
+        }
+    }
+    return load_averages, nil
+}
+
+// Returns total and available memory in bytes.
+func read_memory() (uint64, uint64, error){
+    content, err:=ioutil.ReadFile("/proc/meminfo")
+    if err!=nil{
+        return 0, 0, err
+    }
+
+    total, available:=uint64(0), uint64(0)
+    for _,line:=range strings.Split(string(content), "\n"){
+        fields:=strings.Fields(line)
+        if len(fields)<2{
+            continue
+        }
+
+        value, err:=strconv.ParseUint(fields[1], 10, 64)
+        if err!=nil{
+            continue
+        }
+
+        switch fields[0]{
+        case "MemTotal:":
+            total=value*1024
+        case "MemAvailable:":
+            available=value*1024
+        }
+    }
+    return total, available, nil
+}
+
+// Returns total and free bytes of the filesystem holding path, free as seen by unprivileged users.
+func read_disk(path string) (uint64, uint64, error){
+    var statfs syscall.Statfs_t
+    err:=syscall.Statfs(path, &statfs)
+    if err!=nil{
+        return 0, 0, err
+    }
+    return statfs.Blocks*uint64(statfs.Bsize), statfs.Bavail*uint64(statfs.Bsize), nil
+}
+
+func (b Busy) used_slots() int{
+    used:=0
+    for i:=range b.slots{
+        if b.is_slot_busy(i){
+            used++
+        }
+    }
+    return used
+}
+
+
+
+
+
+
+type Info struct{
+    busy Busy
+    reservations Reservations
+    config ServerConfig
+    start_time time.Time
+}
+
+func (i Info) info_message() (InfoMessage, error){
+    load_averages, err:=read_load_averages()
+    if err!=nil{
+        return InfoMessage{}, err
+    }
+
+    memory_total, memory_available, err:=read_memory()
+    if err!=nil{
+        return InfoMessage{}, err
+    }
+
+    disk_total, disk_free, err:=read_disk(i.config.Scratch_path)
+    if err!=nil{
+        return InfoMessage{}, err
+    }
+
+    capacity, reserved:=i.reservations.get()
+    return InfoMessage{
+        Version: SERVER_VERSION,
+        Uptime_seconds: int64(time.Since(i.start_time).Seconds()),
+        Cpus: runtime.NumCPU(),
+        Load_averages: load_averages,
+        Memory_total_bytes: memory_total,
+        Memory_available_bytes: memory_available,
+        Disk_total_bytes: disk_total,
+        Disk_free_bytes: disk_free,
+        Slots: len(i.busy.slots),
+        Slots_used: i.busy.used_slots(),
+        Busy: i.busy.is_busy() || i.busy.desktop.is_in_use(),
+        Paused: i.busy.desktop.is_paused(),
+        Labels: i.config.Labels,
+        Capacity: capacity,
+        Reserved: reserved,
+    }, nil
+}
+
+func (i Info) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    w.Header().Set("Content-Type", "application/json")
+
+    info_message, err:=i.info_message()
+    if err!=nil{
+        log_error("Error getting info", err)
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not gather info", error_details(err)))
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+    err=json.NewEncoder(w).Encode(&info_message)
+    if err!=nil{
+        log_error("Error encoding info", err)
+    }
+    return
+}
+
+// Answers even when busy or paused, so it doubles as the liveness check.
+type Health struct{}
+
+func (h Health) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+
+    health_message:=HealthMessage{
+        Version: SERVER_VERSION,
+        Protocol_version: PROTOCOL_VERSION,
+        Min_protocol_version: MIN_PROTOCOL_VERSION,
+        Features: SERVER_FEATURES,
+    }
+    err:=json.NewEncoder(w).Encode(&health_message)
+    if err!=nil{
+        log_error("Error encoding health", err)
+    }
+    return
+}
@@ -0,0 +1,198 @@
+package main;
+
+import "path/filepath"
+import "io/ioutil"
+import "syscall"
+import "fmt"
+import "os"
+
+const ISOLATION_NEVER = "never"
+const ISOLATION_ALLOWED = "allowed"
+const ISOLATION_ALWAYS = "always"
+
+const ISOLATION_NEW_ROOT = "/tmp"
+const ISOLATION_OLD_ROOT = "/.old_root"
+
+var DEFAULT_TOOLCHAIN_PATHS = []string{"/usr", "/bin", "/sbin", "/lib", "/lib64", "/etc"}
+var ISOLATION_DEVICES = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"}
+
+type IsolationUnavailable struct{}
+
+func (IsolationUnavailable) Error() string{
+    return "IsolationUnavailable"
+}
+
+// Jobs can opt into isolation when the server allows it, but can not opt out when the server always isolates.
+func isolate_job(server_isolation string, requested bool) (bool, error){
+    switch server_isolation{
+    case ISOLATION_ALWAYS:
+        return true, nil
+    case ISOLATION_ALLOWED:
+        return requested, nil
+    }
+
+    if requested{
+        return false, IsolationUnavailable{}
+    }
+    return false, nil
+}
+
+// Root inside the new namespaces is the user the job would otherwise run as, so it can set up
+// its mounts but has no privileges outside of them.
+func isolate_sys_proc_attr(attr *syscall.SysProcAttr){
+    outer_uid:=os.Getuid()
+    outer_gid:=os.Getgid()
+    if attr.Credential!=nil{
+        outer_uid=int(attr.Credential.Uid)
+        outer_gid=int(attr.Credential.Gid)
+    }
+
+    attr.Cloneflags=syscall.CLONE_NEWNS|syscall.CLONE_NEWPID|syscall.CLONE_NEWNET|syscall.CLONE_NEWUSER|syscall.CLONE_NEWIPC|syscall.CLONE_NEWUTS
+    attr.UidMappings=[]syscall.SysProcIDMap{{ContainerID: 0, HostID: outer_uid, Size: 1}}
+    attr.GidMappings=[]syscall.SysProcIDMap{{ContainerID: 0, HostID: outer_gid, Size: 1}}
+    attr.GidMappingsEnableSetgroups=false
+    attr.Credential=&syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true}
+}
+
+
+
+
+
+
+type IsolationSettings struct{
+    Work_path string `json:"work_path"`
+    Read_only_paths []string `json:"read_only_paths"`
+}
+
+type bind_mount struct{
+    source *os.File
+    path string
+    read_only bool
+}
+
+func open_bind_mounts(paths []string, read_only bool) ([]bind_mount, error){
+    binds:=make([]bind_mount, 0, len(paths))
+    for _,path:=range paths{
+        source, err:=os.Open(path)
+        if os.IsNotExist(err){
+            continue
+        }
+        if err!=nil{
+            return binds, err
+        }
+
+        binds=append(binds, bind_mount{source: source, path: path, read_only: read_only})
+    }
+    return binds, nil
+}
+
+func (b bind_mount) mount(new_root string) error{
+    target:=filepath.Join(new_root, b.path)
+    info, err:=b.source.Stat()
+    if err!=nil{
+        return err
+    }
+
+    if info.IsDir(){
+        err=os.MkdirAll(target, 0755)
+    } else{
+        err=os.MkdirAll(filepath.Dir(target), 0755)
+        if err==nil{
+            err=ioutil.WriteFile(target, nil, 0644)
+        }
+    }
+    if err!=nil{
+        return err
+    }
+
+    err=syscall.Mount(fmt.Sprintf("/proc/self/fd/%d", b.source.Fd()), target, "", syscall.MS_BIND|syscall.MS_REC, "")
+    if err!=nil || !b.read_only{
+        return err
+    }
+
+    // A read only remount inside a user namespace has to keep the flags of the original mount
+    var statfs syscall.Statfs_t
+    err=syscall.Statfs(target, &statfs)
+    if err!=nil{
+        return err
+    }
+
+    kept_flags:=uintptr(statfs.Flags)&(syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_NOATIME|syscall.MS_NODIRATIME|syscall.MS_RELATIME)
+    return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|kept_flags, "")
+}
+
+// Runs in the launcher process, which is root of its own user namespace and pid 1 of its own pid namespace.
+func (i IsolationSettings) enter() error{
+    err:=syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+    if err!=nil{
+        return err
+    }
+
+    // Everything to be bound is opened before the new root gets mounted over part of the old one
+    binds, err:=open_bind_mounts(i.Read_only_paths, true)
+    if err!=nil{
+        return err
+    }
+    devices, err:=open_bind_mounts(ISOLATION_DEVICES, false)
+    if err!=nil{
+        return err
+    }
+    work, err:=open_bind_mounts([]string{i.Work_path}, false)
+    if err!=nil{
+        return err
+    }
+    binds=append(append(binds, devices...), work...)
+
+    err=syscall.Mount("tmpfs", ISOLATION_NEW_ROOT, "tmpfs", 0, "mode=0755")
+    if err!=nil{
+        return err
+    }
+
+    for _,dir:=range []string{"/proc", "/tmp", ISOLATION_OLD_ROOT}{
+        err=os.MkdirAll(filepath.Join(ISOLATION_NEW_ROOT, dir), 0755)
+        if err!=nil{
+            return err
+        }
+    }
+
+    err=syscall.Mount("proc", filepath.Join(ISOLATION_NEW_ROOT, "/proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+    if err!=nil{
+        return err
+    }
+
+    err=syscall.Mount("tmpfs", filepath.Join(ISOLATION_NEW_ROOT, "/tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+    if err!=nil{
+        return err
+    }
+
+    // Binds go last so a work path under /tmp is not hidden by the fresh /tmp
+    for _,bind:=range binds{
+        err=bind.mount(ISOLATION_NEW_ROOT)
+        bind.source.Close()
+        if err!=nil{
+            return err
+        }
+    }
+
+    err=syscall.PivotRoot(ISOLATION_NEW_ROOT, filepath.Join(ISOLATION_NEW_ROOT, ISOLATION_OLD_ROOT))
+    if err!=nil{
+        return err
+    }
+
+    err=syscall.Chdir("/")
+    if err!=nil{
+        return err
+    }
+
+    err=syscall.Unmount(ISOLATION_OLD_ROOT, syscall.MNT_DETACH)
+    if err!=nil{
+        return err
+    }
+
+    err=os.Remove(ISOLATION_OLD_ROOT)
+    if err!=nil{
+        return err
+    }
+
+    return syscall.Chdir(i.Work_path)
+}
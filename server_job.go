@@ -0,0 +1,412 @@
+package main;
+
+import "path/filepath"
+import "net/http"
+import "syscall"
+import "os/exec"
+import "strings"
+import "sort"
+import "bufio"
+import "sync"
+import "time"
+import "fmt"
+import "io"
+import "os"
+
+// Longer lines of job output are not logged, nor anything after them.
+const MAX_JOB_OUTPUT_LINE_BYTES = 1024*1024
+
+var DEFAULT_ENVIRONMENT_ALLOWLIST = []string{"PATH", "LANG", "LC_ALL", "TZ"}
+
+// The environment jobs start from, the server's own unless a clean one is configured.
+func base_environment(clean bool, allowlist []string) []string{
+    if !clean{
+        return os.Environ()
+    }
+
+    env:=make([]string, 0, len(allowlist))
+    for _,name:=range allowlist{
+        value, ok:=os.LookupEnv(name)
+        if ok{
+            env=append(env, name+"="+value)
+        }
+    }
+    return env
+}
+
+type InvalidEnvironment struct{
+    name string
+}
+
+func (i InvalidEnvironment) Error() string{
+    return fmt.Sprintf("InvalidEnvironment(%s)", i.name)
+}
+
+// The WD_ prefix is reserved for the metadata the server injects.
+func validate_environment(env map[string]string) error{
+    for name,value:=range env{
+        if len(name)==0 || strings.ContainsAny(name, "=\x00") || strings.Contains(value, "\x00") || strings.HasPrefix(name, "WD_"){
+            return InvalidEnvironment{name: name}
+        }
+    }
+    return nil
+}
+
+type Job struct{
+    id string
+    slot int
+    host string
+    signer string
+    work_path string
+    base_env []string
+    env map[string]string
+    limits JobLimits
+    scheduling JobScheduling
+    cpus []int
+    credential *syscall.Credential
+    cgroup_root string
+    isolate bool
+    toolchain_paths []string
+    resources JobResources
+    log_path string
+    outputs []string
+    inputs []ArtifactSource
+    artifact_path string
+    artifact_client *http.Client
+}
+
+func (j Job) environment() []string{
+    names:=make([]string, 0, len(j.env))
+    for name:=range j.env{
+        names=append(names, name)
+    }
+    sort.Strings(names)
+
+    env:=make([]string, 0, len(j.base_env)+len(names)+4)
+    env=append(env, j.base_env...)
+    for _,name:=range names{
+        env=append(env, name+"="+j.env[name])
+    }
+
+    return append(env,
+        "WD_JOB_ID="+j.id,
+        "WD_HOST="+j.host,
+        "WD_SIGNER="+j.signer,
+        fmt.Sprintf("WD_SLOT=%d", j.slot),
+    )
+}
+
+func (j Job) command(cgroup *JobCgroup, output *os.File) (*exec.Cmd, error){
+    settings:=LaunchSettings{
+        Rlimits: job_rlimits(j.limits, cgroup==nil),
+        Nice: j.scheduling.Nice,
+        Ioprio: j.scheduling.ioprio(),
+        Cpus: j.cpus,
+    }
+    if !settings.is_empty(){
+        settings.Log_format=logger.format
+    }
+    if j.isolate{
+        work_path, err:=filepath.Abs(j.work_path)
+        if err!=nil{
+            return nil, err
+        }
+        settings.Isolation=&IsolationSettings{Work_path: work_path, Read_only_paths: j.toolchain_paths}
+    }
+
+    cmd, err:=launcher_command(settings, "make")
+    if err!=nil{
+        return nil, err
+    }
+
+    if output!=nil{
+        cmd.Stdout=output
+        cmd.Stderr=output
+    }
+    cmd.Dir=j.work_path
+    cmd.Env=j.environment()
+    cmd.SysProcAttr=&syscall.SysProcAttr{Credential: j.credential, Setpgid: true}
+    if cgroup!=nil{
+        cmd.SysProcAttr.UseCgroupFD=true
+        cmd.SysProcAttr.CgroupFD=int(cgroup.file.Fd())
+    }
+    if j.isolate{
+        isolate_sys_proc_attr(cmd.SysProcAttr)
+    }
+
+    return cmd, nil
+}
+
+// Inputs are fetched by the server before make starts, so the job needs no network for them.
+func (j Job) fetch_inputs() error{
+    for _,input:=range j.inputs{
+        log_info("Fetching artifacts", "job", j.id, "server", input.Host, "input", input.Job)
+        err:=fetch_artifacts(j.artifact_client, input, j.work_path, j.credential)
+        if err!=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// Opened by the server, so the job needs no permissions on the log directory. Without a job log, the output
+// goes into the server's log one record per line, so the log stays parseable. Nil if neither works.
+func (j Job) open_output() *os.File{
+    if len(j.log_path)!=0{
+        output, err:=os.OpenFile(j.log_path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+        if err==nil{
+            return output
+        }
+        log_error("Error opening job log, logging the output instead", err, "job", j.id)
+    }
+
+    reader, writer, err:=os.Pipe()
+    if err!=nil{
+        log_error("Error creating pipe for job output, dropping it", err, "job", j.id)
+        return nil
+    }
+    go log_job_output(reader, j.id)
+    return writer
+}
+
+// Until every process of the job closed its output, which may be after the job finished.
+func log_job_output(reader *os.File, job_id string){
+    defer reader.Close()
+
+    scanner:=bufio.NewScanner(reader)
+    scanner.Buffer(make([]byte, 64*1024), MAX_JOB_OUTPUT_LINE_BYTES)
+    for scanner.Scan(){
+        log_info("Job output", "job", job_id, "line", scanner.Text())
+    }
+    if scanner.Err()!=nil{
+        log_error("Error reading job output, dropping the rest", scanner.Err(), "job", job_id)
+        io.Copy(io.Discard, reader)
+    }
+}
+
+func (j Job) run(busy Busy, running RunningJobs, reservations Reservations, metrics Metrics, history JobHistory){
+    var cgroup *JobCgroup
+    if len(j.cgroup_root)!=0{
+        var err error
+        cgroup, err=create_job_cgroup(j.cgroup_root, "job-"+j.id, j.limits)
+        if err!=nil{
+            log_error("Error creating cgroup, falling back to rlimits", err, "job", j.id)
+        }
+    }
+
+    if cgroup==nil && j.limits.Cpus>0{
+        log_warning("Cpu limit is not enforced without cgroups", "job", j.id)
+    }
+
+    log_info("Executing", "work_path", j.work_path, "job", j.id, "slot", j.slot)
+    output:=j.open_output()
+    var cmd *exec.Cmd
+    err:=j.fetch_inputs()
+    if err==nil{
+        cmd, err=j.command(cgroup, output)
+    }
+    if err==nil{
+        err=cmd.Start()
+    }
+    slot, holds_slot:=j.slot, true
+    start_time:=time.Now()
+    duration:=0.0
+    if err==nil{
+        metrics.increment(METRIC_JOBS_STARTED, "")
+        running.add(&RunningJob{id: j.id, work_path: j.work_path, slot: j.slot, holds_slot: true, pid: cmd.Process.Pid, cgroup: cgroup})
+        history.started(j.id, start_time)
+        err=cmd.Wait()
+        running_job:=running.remove(j.id)
+        slot, holds_slot=running_job.slot, running_job.holds_slot
+        duration=time.Since(start_time).Seconds()
+        metrics.observe_job_duration(duration)
+    }
+    if output!=nil{
+        output.Close()
+    }
+
+    // Whatever the job left running is killed before its outputs are packed, so nothing changes them meanwhile.
+    oom_killed:=err!=nil && cgroup!=nil && cgroup.oom_killed()
+    if cgroup!=nil{
+        cgroup.remove()
+    }else if cmd!=nil && cmd.ProcessState!=nil{
+        syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+
+    // A job whose outputs are missing failed as far as its dependents are concerned.
+    var artifacts []string
+    if err==nil && len(j.outputs)!=0{
+        artifacts, err=collect_artifacts(j.work_path, j.outputs, artifact_archive_path(j.artifact_path, j.id), j.credential)
+    }
+
+    outcome:=JOB_OUTCOME_SUCCEEDED
+    if oom_killed{
+        outcome=JOB_OUTCOME_OOM_KILLED
+    }else if err!=nil{
+        outcome=JOB_OUTCOME_FAILED
+    }
+
+    // -1 when the command did not start or was killed by a signal.
+    exit_code:=-1
+    if cmd!=nil && cmd.ProcessState!=nil{
+        exit_code=cmd.ProcessState.ExitCode()
+    }
+
+    metrics.increment(METRIC_JOBS_FINISHED, label("outcome", outcome))
+    reservations.release(j.resources)
+    history.set(JobStatusMessage{
+        Job: j.id,
+        Work_path: j.work_path,
+        State: JOB_STATE_FINISHED,
+        Outcome: outcome,
+        Exit_code: &exit_code,
+        Started_unix: start_time.Unix(),
+        Duration_seconds: duration,
+        Log_path: j.log_path,
+        Artifacts: artifacts,
+    })
+    busy.events.publish(EventMessage{Type: EVENT_JOB_FINISHED, Slot: slot, Job: j.id, Work_path: j.work_path, Outcome: outcome, Exit_code: &exit_code})
+    if holds_slot && !busy.make_free(slot){
+        log_error("Attempted to make busy free while it was already free", nil, "job", j.id, "slot", slot)
+        return
+    }
+
+    switch outcome{
+    case JOB_OUTCOME_OOM_KILLED:
+        log_error("Command was killed for running out of memory", nil, "work_path", j.work_path, "job", j.id)
+    case JOB_OUTCOME_FAILED:
+        log_error("Error while running command", err, "work_path", j.work_path, "job", j.id)
+    default:
+        log_info("Command was executed successfully", "work_path", j.work_path, "job", j.id)
+    }
+}
+
+
+
+
+
+
+// A job whose process is running. The pid is also the job's process group. A job is stopped while it
+// is suspended or paused, and a suspended job may have given up its slot.
+type RunningJob struct{
+    id string
+    work_path string
+    slot int
+    holds_slot bool
+    pid int
+    cgroup *JobCgroup
+    suspended bool
+    paused bool
+    stopped bool
+}
+
+// Stops or continues the job's whole process tree, by freezing its cgroup when it has one.
+func (r *RunningJob) update_stopped() error{
+    stopped:=r.suspended || r.paused
+    if r.stopped==stopped{
+        return nil
+    }
+
+    var err error
+    if r.cgroup!=nil{
+        err=r.cgroup.freeze(stopped)
+    } else if stopped{
+        err=syscall.Kill(-r.pid, syscall.SIGSTOP)
+    } else{
+        err=syscall.Kill(-r.pid, syscall.SIGCONT)
+    }
+
+    if err==nil{
+        r.stopped=stopped
+    }
+    return err
+}
+
+func (r *RunningJob) set_paused(paused bool) error{
+    r.paused=paused
+    return r.update_stopped()
+}
+
+type UnknownJob struct{}
+
+func (UnknownJob) Error() string{
+    return "UnknownJob"
+}
+
+type NoFreeSlot struct{}
+
+func (NoFreeSlot) Error() string{
+    return "NoFreeSlot"
+}
+
+type RunningJobs struct{
+    mutex *sync.Mutex
+    jobs map[string]*RunningJob
+}
+
+func (r RunningJobs) add(job *RunningJob){
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.jobs[job.id]=job
+}
+
+func (r RunningJobs) remove(id string) *RunningJob{
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    job:=r.jobs[id]
+    delete(r.jobs, id)
+    return job
+}
+
+// Calls f for every running job while holding the lock, so f may change them.
+func (r RunningJobs) for_each(f func(job *RunningJob)){
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for _,job:=range r.jobs{
+        f(job)
+    }
+}
+
+func (r RunningJobs) suspend(id string, keep_slot bool, busy Busy) error{
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    job, ok:=r.jobs[id]
+    if !ok{
+        return UnknownJob{}
+    }
+
+    job.suspended=true
+    err:=job.update_stopped()
+    if err!=nil{
+        job.suspended=false
+        return err
+    }
+
+    if !keep_slot && job.holds_slot{
+        busy.make_free(job.slot)
+        job.holds_slot=false
+    }
+    return nil
+}
+
+// A job that gave up its slot needs to get one back first, which need not be the one it had.
+func (r RunningJobs) resume(id string, busy Busy) error{
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    job, ok:=r.jobs[id]
+    if !ok{
+        return UnknownJob{}
+    }
+
+    if !job.holds_slot{
+        slot, ok:=busy.make_busy()
+        if !ok{
+            return NoFreeSlot{}
+        }
+        job.slot=slot
+        job.holds_slot=true
+    }
+
+    job.suspended=false
+    return job.update_stopped()
+}
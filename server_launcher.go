@@ -0,0 +1,120 @@
+package main;
+
+import "encoding/json"
+import "syscall"
+import "os/exec"
+import "os"
+
+const LAUNCH_JOB_ARG = "launch_job"
+
+// Whatever has to happen inside the job's process before make starts is done by
+// re-executing the server as a launcher, which applies these settings to itself and then execs the command.
+// Log_format is the server's, so a launcher that fails logs like the server does.
+type LaunchSettings struct{
+    Rlimits map[int]uint64 `json:"rlimits,omitempty"`
+    Isolation *IsolationSettings `json:"isolation,omitempty"`
+    Nice int `json:"nice,omitempty"`
+    Ioprio int `json:"ioprio,omitempty"`
+    Cpus []int `json:"cpus,omitempty"`
+    Log_format string `json:"log_format,omitempty"`
+}
+
+func (l LaunchSettings) is_empty() bool{
+    return len(l.Rlimits)==0 && l.Isolation==nil && l.Nice==0 && l.Ioprio==0 && len(l.Cpus)==0
+}
+
+type MalformedLauncherArgs struct{}
+
+func (MalformedLauncherArgs) Error() string{
+    return "MalformedLauncherArgs"
+}
+
+func launcher_command(settings LaunchSettings, name string, args ...string) (*exec.Cmd, error){
+    if settings.is_empty(){
+        return exec.Command(name, args...), nil
+    }
+
+    settings_in_bytes, err:=json.Marshal(&settings)
+    if err!=nil{
+        return nil, err
+    }
+
+    all_args:=append([]string{LAUNCH_JOB_ARG, string(settings_in_bytes), "--", name}, args...)
+    return exec.Command("/proc/self/exe", all_args...), nil
+}
+
+func set_rlimit(resource int, value uint64) error{
+    var rlimit syscall.Rlimit
+    err:=syscall.Getrlimit(resource, &rlimit)
+    if err!=nil{
+        return err
+    }
+
+    if value<rlimit.Max{
+        rlimit.Max=value
+    }
+    rlimit.Cur=rlimit.Max
+    return syscall.Setrlimit(resource, &rlimit)
+}
+
+// Runs in the launcher process, only returns on error.
+func launch_job(args []string) error{
+    if len(args)<3 || args[1]!="--"{
+        return MalformedLauncherArgs{}
+    }
+
+    var settings LaunchSettings
+    err:=json.Unmarshal([]byte(args[0]), &settings)
+    if err!=nil{
+        return err
+    }
+
+    if len(settings.Log_format)!=0{
+        err=set_log_format(settings.Log_format)
+        if err!=nil{
+            return err
+        }
+    }
+
+    for resource,value:=range settings.Rlimits{
+        err=set_rlimit(resource, value)
+        if err!=nil{
+            return err
+        }
+    }
+
+    if settings.Nice!=0{
+        err=syscall.Setpriority(syscall.PRIO_PROCESS, 0, settings.Nice)
+        if err!=nil{
+            return err
+        }
+    }
+
+    if settings.Ioprio!=0{
+        err=set_ioprio(settings.Ioprio)
+        if err!=nil{
+            return err
+        }
+    }
+
+    if len(settings.Cpus)!=0{
+        err=set_cpu_affinity(settings.Cpus)
+        if err!=nil{
+            return err
+        }
+    }
+
+    if settings.Isolation!=nil{
+        err=settings.Isolation.enter()
+        if err!=nil{
+            return err
+        }
+    }
+
+    path, err:=exec.LookPath(args[2])
+    if err!=nil{
+        return err
+    }
+
+    return syscall.Exec(path, args[2:], os.Environ())
+}
@@ -0,0 +1,222 @@
+package main;
+
+import "encoding/json"
+import "crypto/ecdsa"
+import "net/http"
+import "net"
+import "sync"
+import "time"
+import "fmt"
+
+// Long enough to sign and submit, short enough that a client that never submits does not hold a slot for long.
+const LEASE_DURATION = 5*time.Second
+
+// How far a claim's timestamp may be from the server's clock, either way.
+const CLAIM_WINDOW = time.Minute
+
+type Lease struct{
+    id string
+    challenge uint64
+    slot int
+    address string
+}
+
+type UnknownLease struct{
+    id string
+}
+
+func (u UnknownLease) Error() string{
+    return fmt.Sprintf("UnknownLease(%s)", u.id)
+}
+
+// A lease is taken exactly once, either by the work submitted for it or by its expiry, which frees its slot.
+type Leases struct{
+    mutex *sync.Mutex
+    leases map[string]Lease
+}
+
+// Returns false, and keeps nothing, if the lease's address already holds max_leases leases.
+func (l Leases) add(lease Lease, busy Busy, max_leases int) bool{
+    l.mutex.Lock()
+    held:=0
+    for _,other:=range l.leases{
+        if other.address==lease.address{
+            held++
+        }
+    }
+    if held>=max_leases{
+        l.mutex.Unlock()
+        return false
+    }
+    l.leases[lease.id]=lease
+    l.mutex.Unlock()
+
+    time.AfterFunc(LEASE_DURATION, func(){
+        expired, err:=l.take(lease.id)
+        if err==nil{
+            busy.make_free(expired.slot)
+            log_info("Lease expired", "lease", expired.id, "slot", expired.slot)
+        }
+    })
+    return true
+}
+
+func (l Leases) take(id string) (Lease, error){
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    lease, ok:=l.leases[id]
+    if !ok{
+        return lease, UnknownLease{id: id}
+    }
+    delete(l.leases, id)
+    return lease, nil
+}
+
+// Gives the slot of a lease back right away, for work that was refused before it got to use the lease.
+func (l Leases) release(id string, busy Busy){
+    lease, err:=l.take(id)
+    if err==nil{
+        busy.make_free(lease.slot)
+    }
+}
+
+
+
+
+type ClaimReplayed struct{}
+
+func (ClaimReplayed) Error() string{
+    return "ClaimReplayed"
+}
+
+// Random values of signed claims, kept until their timestamp leaves the window. A claim is taken only once.
+type ClaimReplays struct{
+    mutex *sync.Mutex
+    seen map[uint64]time.Time
+}
+
+func new_claim_replays() ClaimReplays{
+    return ClaimReplays{mutex: &sync.Mutex{}, seen: make(map[uint64]time.Time)}
+}
+
+func (c ClaimReplays) take(random uint64, expires time.Time) error{
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    now:=time.Now()
+    for seen_random, seen_expires:=range c.seen{
+        if now.After(seen_expires){
+            delete(c.seen, seen_random)
+        }
+    }
+
+    if _, ok:=c.seen[random]; ok{
+        return ClaimReplayed{}
+    }
+    c.seen[random]=expires
+    return nil
+}
+
+// Takes a slot and hands out a lease on it with a challenge to sign, all in one round trip. The claim itself is
+// signed, so clients without the key cannot hold slots.
+type Claim struct{
+    replays ClaimReplays
+    busy Busy
+    leases Leases
+    metrics Metrics
+    public_key *ecdsa.PublicKey
+}
+
+func (c Claim) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    claim_request:=ClaimRequest{}
+    err:=json.NewDecoder(r.Body).Decode(&claim_request)
+    if err!=nil{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "could not decode claim", error_details(err)))
+        log_error("Error decoding claim", err)
+        return
+    }
+
+    timestamp:=time.UnixMilli(claim_request.Timestamp_ms)
+    skew:=time.Since(timestamp)
+    if skew>CLAIM_WINDOW || skew< -CLAIM_WINDOW{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_CLOCK_SKEW, "claim timestamp is too far from the server's clock", error_details(nil, "server_time_ms", fmt.Sprint(time.Now().UnixMilli()))))
+        c.metrics.increment(METRIC_CLAIMS_REFUSED, label("reason", "clock_skew"))
+        log_warning("Refusing claim, clocks are too far apart", "skew", skew)
+        return
+    }
+
+    // Checked before the claim is remembered, so only clients with the key can fill the replay set.
+    signature_r, signature_s, err:=parse_signature(claim_request.Signature_r, claim_request.Signature_s)
+    if err==nil{
+        err=verify_signature(c.public_key, signature_r, signature_s, 0, func(uint64) (string, error){
+            return claim_request.string_to_sign(), nil
+        })
+    }
+    if err==nil{
+        err=c.replays.take(claim_request.Random, timestamp.Add(CLAIM_WINDOW))
+    }
+    if _, replayed:=err.(ClaimReplayed); replayed{
+        write_error(w, http.StatusUnauthorized, new_error_message(ERROR_UNAUTHORIZED, "claim was already used", nil))
+        c.metrics.increment(METRIC_CLAIMS_REFUSED, label("reason", "replayed"))
+        log_error("Refusing replayed claim", err)
+        return
+    }
+    if err!=nil{
+        write_signature_error(w, err, c.metrics)
+        return
+    }
+
+    if c.busy.desktop.is_in_use(){
+        write_error(w, http.StatusPreconditionFailed, new_error_message(ERROR_IN_USE, "machine is in use", nil))
+        c.metrics.increment(METRIC_CLAIMS_REFUSED, label("reason", "in_use"))
+        return
+    }
+
+    address, _, err:=net.SplitHostPort(r.RemoteAddr)
+    if err!=nil{
+        address=r.RemoteAddr
+    }
+
+    lease_id, err:=get_random_u64()
+    if err!=nil{
+        log_error("Error generating lease id", err)
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not generate a lease", error_details(err)))
+        return
+    }
+
+    challenge, err:=get_random_u64()
+    if err!=nil || challenge==0{
+        log_error("Error generating challenge", err)
+        write_error(w, http.StatusInternalServerError, new_error_message(ERROR_INTERNAL, "could not generate a challenge", error_details(err)))
+        return
+    }
+
+    slot, ok:=c.busy.make_busy()
+    if !ok{
+        write_error(w, http.StatusPreconditionFailed, new_error_message(ERROR_BUSY, "all slots are busy", nil))
+        c.metrics.increment(METRIC_CLAIMS_REFUSED, label("reason", "busy"))
+        return
+    }
+
+    // One client plans several entries onto a host and claims them all at once, and clients behind one address
+    // look like one, so an address may hold as many leases as there are slots.
+    max_leases:=len(c.busy.slots)
+    lease:=Lease{id: fmt.Sprintf("%016x", lease_id), challenge: challenge, slot: slot, address: address}
+    if !c.leases.add(lease, c.busy, max_leases){
+        c.busy.make_free(slot)
+        write_error(w, http.StatusTooManyRequests, new_error_message(ERROR_TOO_MANY_LEASES, "too many leases held from this address", error_details(nil, "max_leases", fmt.Sprint(max_leases))))
+        c.metrics.increment(METRIC_CLAIMS_REFUSED, label("reason", "too_many_leases"))
+        log_warning("Refusing claim, too many leases held", "address", address)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    claim_message:=ClaimMessage{Lease: lease.id, Challenge: lease.challenge, Expires_in_ms: LEASE_DURATION.Milliseconds()}
+    err=json.NewEncoder(w).Encode(&claim_message)
+    if err!=nil{
+        log_error("Error encoding claim", err)
+    }
+    return
+}
@@ -0,0 +1,176 @@
+package main;
+
+import "path/filepath"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "syscall"
+import "time"
+import "fmt"
+import "os"
+
+const RLIMIT_NPROC = 6
+const CPU_PERIOD_US = 100000
+
+func bound_u64(value uint64, default_value uint64, maximum uint64) uint64{
+    if value==0{
+        value=default_value
+    }
+    if maximum!=0 && (value==0 || value>maximum){
+        value=maximum
+    }
+    return value
+}
+
+func bound_f64(value float64, default_value float64, maximum float64) float64{
+    if value<=0{
+        value=default_value
+    }
+    if maximum>0 && (value<=0 || value>maximum){
+        value=maximum
+    }
+    return value
+}
+
+// Unset requested values take the defaults, everything is clamped to the maximums.
+func effective_limits(requested *JobLimits, defaults JobLimits, maximums JobLimits) JobLimits{
+    var limits JobLimits
+    if requested!=nil{
+        limits=*requested
+    }
+
+    return JobLimits{
+        Cpus: bound_f64(limits.Cpus, defaults.Cpus, maximums.Cpus),
+        Memory_bytes: bound_u64(limits.Memory_bytes, defaults.Memory_bytes, maximums.Memory_bytes),
+        Max_processes: bound_u64(limits.Max_processes, defaults.Max_processes, maximums.Max_processes),
+        Max_open_files: bound_u64(limits.Max_open_files, defaults.Max_open_files, maximums.Max_open_files),
+    }
+}
+
+
+
+
+
+
+type NotACgroup struct{}
+
+func (NotACgroup) Error() string{
+    return "NotACgroup"
+}
+
+func setup_cgroup_root(root string) error{
+    err:=os.MkdirAll(root, 0755)
+    if err!=nil{
+        return err
+    }
+
+    _, err=os.Stat(filepath.Join(root, "cgroup.controllers"))
+    if err!=nil{
+        return NotACgroup{}
+    }
+
+    return ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644)
+}
+
+type JobCgroup struct{
+    path string
+    file *os.File
+}
+
+func create_job_cgroup(root string, name string, limits JobLimits) (*JobCgroup, error){
+    cgroup:=&JobCgroup{path: filepath.Join(root, name)}
+    err:=os.Mkdir(cgroup.path, 0755)
+    if err!=nil{
+        return nil, err
+    }
+
+    settings:=make(map[string]string)
+    if limits.Cpus>0{
+        settings["cpu.max"]=fmt.Sprintf("%d %d", int64(limits.Cpus*CPU_PERIOD_US), CPU_PERIOD_US)
+    }
+    if limits.Memory_bytes!=0{
+        settings["memory.max"]=fmt.Sprintf("%d", limits.Memory_bytes)
+        settings["memory.oom.group"]="1"
+    }
+    if limits.Max_processes!=0{
+        settings["pids.max"]=fmt.Sprintf("%d", limits.Max_processes)
+    }
+
+    for setting,value:=range settings{
+        err=ioutil.WriteFile(filepath.Join(cgroup.path, setting), []byte(value), 0644)
+        if err!=nil{
+            cgroup.remove()
+            return nil, err
+        }
+    }
+
+    cgroup.file, err=os.Open(cgroup.path)
+    if err!=nil{
+        cgroup.remove()
+        return nil, err
+    }
+
+    return cgroup, nil
+}
+
+func (c *JobCgroup) oom_killed() bool{
+    content, err:=ioutil.ReadFile(filepath.Join(c.path, "memory.events"))
+    if err!=nil{
+        return false
+    }
+
+    for _,line:=range strings.Split(string(content), "\n"){
+        fields:=strings.Fields(line)
+        if len(fields)==2 && fields[0]=="oom_kill"{
+            count, err:=strconv.ParseUint(fields[1], 10, 64)
+            return err==nil && count!=0
+        }
+    }
+
+    return false
+}
+
+func (c *JobCgroup) freeze(frozen bool) error{
+    value:="0"
+    if frozen{
+        value="1"
+    }
+    return ioutil.WriteFile(filepath.Join(c.path, "cgroup.freeze"), []byte(value), 0644)
+}
+
+// Kills whatever the job left behind and removes the cgroup.
+func (c *JobCgroup) remove(){
+    if c.file!=nil{
+        c.file.Close()
+    }
+
+    ioutil.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644)
+    for i:=0;i<50;i++{
+        err:=os.Remove(c.path)
+        if err==nil || os.IsNotExist(err){
+            return
+        }
+        time.Sleep(100*time.Millisecond)
+    }
+    log_error("Could not remove cgroup", nil, "cgroup", c.path)
+}
+
+
+
+
+
+
+// Rlimits are set by the launcher on itself, they are the only option without cgroups and the only way to limit open files.
+func job_rlimits(limits JobLimits, without_cgroup bool) map[int]uint64{
+    rlimits:=make(map[int]uint64)
+    if limits.Max_open_files!=0{
+        rlimits[syscall.RLIMIT_NOFILE]=limits.Max_open_files
+    }
+    if without_cgroup && limits.Memory_bytes!=0{
+        rlimits[syscall.RLIMIT_AS]=limits.Memory_bytes
+    }
+    if without_cgroup && limits.Max_processes!=0{
+        rlimits[RLIMIT_NPROC]=limits.Max_processes
+    }
+    return rlimits
+}
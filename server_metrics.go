@@ -0,0 +1,206 @@
+package main;
+
+import "net/http"
+import "strings"
+import "sort"
+import "sync"
+import "fmt"
+
+const METRIC_JOBS_STARTED = "work_distributer_jobs_started_total"
+const METRIC_JOBS_FINISHED = "work_distributer_jobs_finished_total"
+const METRIC_JOBS_REFUSED = "work_distributer_jobs_refused_total"
+const METRIC_CLAIMS_REFUSED = "work_distributer_claims_refused_total"
+const METRIC_SIGNATURE_FAILURES = "work_distributer_signature_failures_total"
+const METRIC_NONCE_ERRORS = "work_distributer_nonce_errors_total"
+const METRIC_JOB_DURATION = "work_distributer_job_duration_seconds"
+
+var METRIC_HELP = map[string]string{
+    METRIC_JOBS_STARTED: "Jobs that were started.",
+    METRIC_JOBS_FINISHED: "Jobs that finished, by outcome.",
+    METRIC_JOBS_REFUSED: "Signed work requests that were refused, by reason.",
+    METRIC_CLAIMS_REFUSED: "Signed claims that were refused, by reason.",
+    METRIC_SIGNATURE_FAILURES: "Requests whose signature was malformed or did not check out.",
+    METRIC_NONCE_ERRORS: "Times the nonce was found in its error state.",
+    METRIC_JOB_DURATION: "How long jobs ran, from start to exit.",
+}
+
+var JOB_DURATION_BUCKETS = []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400, 43200}
+
+// Counters are kept per label set, e.g. `outcome="failed"`, the empty string being no labels.
+type Metrics struct{
+    mutex *sync.Mutex
+    counters map[string]map[string]uint64
+    duration_counts []uint64
+    duration_sum *float64
+    duration_count *uint64
+}
+
+func new_metrics() Metrics{
+    metrics:=Metrics{
+        mutex: &sync.Mutex{},
+        counters: make(map[string]map[string]uint64),
+        duration_counts: make([]uint64, len(JOB_DURATION_BUCKETS)),
+        duration_sum: new(float64),
+        duration_count: new(uint64),
+    }
+
+    // Known series start at zero, so they exist before anything happened
+    metrics.add(METRIC_JOBS_STARTED, "", 0)
+    for _,outcome:=range []string{JOB_OUTCOME_SUCCEEDED, JOB_OUTCOME_FAILED, JOB_OUTCOME_OOM_KILLED}{
+        metrics.add(METRIC_JOBS_FINISHED, label("outcome", outcome), 0)
+    }
+    metrics.add(METRIC_SIGNATURE_FAILURES, "", 0)
+    metrics.add(METRIC_NONCE_ERRORS, "", 0)
+    return metrics
+}
+
+func label(name string, value string) string{
+    return fmt.Sprintf("%s=%q", name, value)
+}
+
+func (m Metrics) add(name string, labels string, value uint64){
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if m.counters[name]==nil{
+        m.counters[name]=make(map[string]uint64)
+    }
+    m.counters[name][labels]+=value
+}
+
+func (m Metrics) increment(name string, labels string){
+    m.add(name, labels, 1)
+}
+
+func (m Metrics) observe_job_duration(seconds float64){
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    for i,bucket:=range JOB_DURATION_BUCKETS{
+        if seconds<=bucket{
+            m.duration_counts[i]++
+        }
+    }
+    *m.duration_sum+=seconds
+    *m.duration_count++
+}
+
+func write_series(b *strings.Builder, name string, labels string, value interface{}){
+    if len(labels)==0{
+        fmt.Fprintf(b, "%s %v\n", name, value)
+    } else{
+        fmt.Fprintf(b, "%s{%s} %v\n", name, labels, value)
+    }
+}
+
+func write_family(b *strings.Builder, name string, kind string, help string){
+    fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Renders everything in the Prometheus text format.
+func (m Metrics) render(gauges map[string]float64) string{
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    var b strings.Builder
+    names:=make([]string, 0, len(m.counters))
+    for name:=range m.counters{
+        names=append(names, name)
+    }
+    sort.Strings(names)
+
+    for _,name:=range names{
+        write_family(&b, name, "counter", METRIC_HELP[name])
+        label_sets:=make([]string, 0, len(m.counters[name]))
+        for labels:=range m.counters[name]{
+            label_sets=append(label_sets, labels)
+        }
+        sort.Strings(label_sets)
+        for _,labels:=range label_sets{
+            write_series(&b, name, labels, m.counters[name][labels])
+        }
+    }
+
+    write_family(&b, METRIC_JOB_DURATION, "histogram", METRIC_HELP[METRIC_JOB_DURATION])
+    for i,bucket:=range JOB_DURATION_BUCKETS{
+        write_series(&b, METRIC_JOB_DURATION+"_bucket", label("le", fmt.Sprint(bucket)), m.duration_counts[i])
+    }
+    write_series(&b, METRIC_JOB_DURATION+"_bucket", label("le", "+Inf"), *m.duration_count)
+    write_series(&b, METRIC_JOB_DURATION+"_sum", "", *m.duration_sum)
+    write_series(&b, METRIC_JOB_DURATION+"_count", "", *m.duration_count)
+
+    gauge_names:=make([]string, 0, len(gauges))
+    for name:=range gauges{
+        gauge_names=append(gauge_names, name)
+    }
+    sort.Strings(gauge_names)
+    for _,name:=range gauge_names{
+        write_family(&b, name, "gauge", GAUGE_HELP[name])
+        write_series(&b, name, "", gauges[name])
+    }
+
+    return b.String()
+}
+
+
+
+
+
+
+var GAUGE_HELP = map[string]string{
+    "work_distributer_slots": "Slots this server has.",
+    "work_distributer_slots_used": "Slots currently held by jobs.",
+    "work_distributer_jobs_running": "Jobs whose process is running, including stopped ones.",
+    "work_distributer_jobs_suspended": "Jobs suspended through the job control endpoints.",
+    "work_distributer_in_use": "1 while someone is using the machine interactively.",
+    "work_distributer_paused": "1 while jobs are paused for interactive use.",
+    "work_distributer_reserved_cpus": "Cpus reserved by running jobs.",
+    "work_distributer_reserved_memory_bytes": "Memory reserved by running jobs.",
+    "work_distributer_reserved_disk_bytes": "Scratch disk reserved by running jobs.",
+}
+
+func bool_gauge(value bool) float64{
+    if value{
+        return 1
+    }
+    return 0
+}
+
+type MetricsHandler struct{
+    metrics Metrics
+    busy Busy
+    running RunningJobs
+    reservations Reservations
+}
+
+func (m MetricsHandler) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+    jobs_running, jobs_suspended:=0, 0
+    m.running.for_each(func(job *RunningJob){
+        jobs_running++
+        if job.suspended{
+            jobs_suspended++
+        }
+    })
+    _, reserved:=m.reservations.get()
+
+    gauges:=map[string]float64{
+        "work_distributer_slots": float64(len(m.busy.slots)),
+        "work_distributer_slots_used": float64(m.busy.used_slots()),
+        "work_distributer_jobs_running": float64(jobs_running),
+        "work_distributer_jobs_suspended": float64(jobs_suspended),
+        "work_distributer_in_use": bool_gauge(m.busy.desktop.is_in_use()),
+        "work_distributer_paused": bool_gauge(m.busy.desktop.is_paused()),
+        "work_distributer_reserved_cpus": reserved.Cpus,
+        "work_distributer_reserved_memory_bytes": float64(reserved.Memory_bytes),
+        "work_distributer_reserved_disk_bytes": float64(reserved.Disk_bytes),
+    }
+
+    w.WriteHeader(http.StatusOK)
+    _, err:=w.Write([]byte(m.metrics.render(gauges)))
+    if err!=nil{
+        log_error("Error writing metrics", err)
+    }
+    return
+}
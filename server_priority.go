@@ -0,0 +1,120 @@
+package main;
+
+import "syscall"
+import "unsafe"
+
+const IOPRIO_WHO_PROCESS = 1
+const IOPRIO_CLASS_SHIFT = 13
+const MAX_CPUS = 1024
+
+// Ordered from highest to lowest priority, jobs can only ever move down this list. The index is the kernel's
+// class number, "" leaves the class alone.
+var IO_CLASSES = []string{"", "realtime", "best-effort", "idle"}
+const IO_CLASS_BEST_EFFORT = 2
+
+type InvalidScheduling struct{}
+
+func (InvalidScheduling) Error() string{
+    return "InvalidScheduling"
+}
+
+func io_class_index(io_class string) (int, error){
+    for i,name:=range IO_CLASSES{
+        if name==io_class{
+            return i, nil
+        }
+    }
+    return 0, InvalidScheduling{}
+}
+
+// Processes without a class are best-effort to the kernel, so that is where "" ranks. Realtime ranks above it and
+// is only open to jobs on servers configured for it.
+func io_class_rank(io_class string) int{
+    class, _:=io_class_index(io_class)
+    if class==0{
+        return IO_CLASS_BEST_EFFORT
+    }
+    return class
+}
+
+func validate_scheduling(scheduling JobScheduling) error{
+    if scheduling.Nice < -20 || scheduling.Nice > 19 || scheduling.Io_priority < 0 || scheduling.Io_priority > 7{
+        return InvalidScheduling{}
+    }
+    _, err:=io_class_index(scheduling.Io_class)
+    return err
+}
+
+func validate_cpus(cpus []int) error{
+    for _,cpu:=range cpus{
+        if cpu<0 || cpu>=MAX_CPUS{
+            return InvalidScheduling{}
+        }
+    }
+    return nil
+}
+
+// Jobs may ask to be nicer than the server's defaults, but never less nice.
+func effective_scheduling(requested *JobScheduling, defaults JobScheduling) (JobScheduling, error){
+    if requested==nil{
+        return defaults, nil
+    }
+
+    err:=validate_scheduling(*requested)
+    if err!=nil{
+        return defaults, err
+    }
+
+    scheduling:=defaults
+    if requested.Nice>scheduling.Nice{
+        scheduling.Nice=requested.Nice
+    }
+
+    // Without a class the kernel derives the best-effort priority from the nice value.
+    default_priority:=defaults.Io_priority
+    if len(defaults.Io_class)==0{
+        default_priority=(scheduling.Nice+20)/5
+    }
+
+    requested_class:=io_class_rank(requested.Io_class)
+    default_class:=io_class_rank(defaults.Io_class)
+    if requested_class>default_class{
+        scheduling.Io_class=requested.Io_class
+        scheduling.Io_priority=requested.Io_priority
+    } else if requested_class==default_class && len(requested.Io_class)!=0 && requested.Io_priority>default_priority{
+        scheduling.Io_class=requested.Io_class
+        scheduling.Io_priority=requested.Io_priority
+    }
+
+    return scheduling, nil
+}
+
+// The value ioprio_set expects, 0 leaves the io priority alone.
+func (s JobScheduling) ioprio() int{
+    class, err:=io_class_index(s.Io_class)
+    if err!=nil || class==0{
+        return 0
+    }
+    return class<<IOPRIO_CLASS_SHIFT | s.Io_priority
+}
+
+func set_ioprio(ioprio int) error{
+    _, _, errno:=syscall.Syscall(syscall.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, 0, uintptr(ioprio))
+    if errno!=0{
+        return errno
+    }
+    return nil
+}
+
+func set_cpu_affinity(cpus []int) error{
+    var mask [MAX_CPUS/64]uint64
+    for _,cpu:=range cpus{
+        mask[cpu/64]|=1<<uint(cpu%64)
+    }
+
+    _, _, errno:=syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+    if errno!=0{
+        return errno
+    }
+    return nil
+}
@@ -0,0 +1,107 @@
+package main;
+
+import "runtime"
+import "math"
+import "sync"
+
+type InvalidResources struct{}
+
+func (InvalidResources) Error() string{
+    return "InvalidResources"
+}
+
+type InsufficientResources struct{}
+
+func (InsufficientResources) Error() string{
+    return "InsufficientResources"
+}
+
+func validate_resources(resources *JobResources) error{
+    if resources==nil{
+        return nil
+    }
+    if resources.Cpus<0 || math.IsNaN(resources.Cpus) || math.IsInf(resources.Cpus, 0){
+        return InvalidResources{}
+    }
+    return nil
+}
+
+// Unconfigured capacities default to the whole machine.
+func default_capacity(capacity JobResources, scratch_path string) (JobResources, error){
+    if capacity.Cpus<=0{
+        capacity.Cpus=float64(runtime.NumCPU())
+    }
+
+    if capacity.Memory_bytes==0{
+        memory_total, _, err:=read_memory()
+        if err!=nil{
+            return capacity, err
+        }
+        capacity.Memory_bytes=memory_total
+    }
+
+    if capacity.Disk_bytes==0{
+        disk_total, _, err:=read_disk(scratch_path)
+        if err!=nil{
+            return capacity, err
+        }
+        capacity.Disk_bytes=disk_total
+    }
+
+    return capacity, nil
+}
+
+type Reservations struct{
+    mutex *sync.Mutex
+    reserved *JobResources
+    capacity JobResources
+    scratch_path string
+}
+
+func (r Reservations) get() (JobResources, JobResources){
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.capacity, *r.reserved
+}
+
+// Admits a request only if the unreserved capacity covers it. Disk also has to be actually free, since
+// anything else on the machine may be using it.
+func (r Reservations) reserve(request JobResources) error{
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    // Against what is left rather than reserved plus request, which a huge request could wrap around.
+    // Reservations never go past capacity, so nothing here goes below zero.
+    if request.Cpus>r.capacity.Cpus-r.reserved.Cpus ||
+        request.Memory_bytes>r.capacity.Memory_bytes-r.reserved.Memory_bytes ||
+        request.Disk_bytes>r.capacity.Disk_bytes-r.reserved.Disk_bytes{
+        return InsufficientResources{}
+    }
+
+    if request.Disk_bytes!=0{
+        _, disk_free, err:=read_disk(r.scratch_path)
+        if err!=nil{
+            return err
+        }
+        if request.Disk_bytes>disk_free{
+            return InsufficientResources{}
+        }
+    }
+
+    r.reserved.Cpus+=request.Cpus
+    r.reserved.Memory_bytes+=request.Memory_bytes
+    r.reserved.Disk_bytes+=request.Disk_bytes
+    return nil
+}
+
+func (r Reservations) release(request JobResources){
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    r.reserved.Cpus-=request.Cpus
+    if r.reserved.Cpus<0{
+        r.reserved.Cpus=0
+    }
+    r.reserved.Memory_bytes-=request.Memory_bytes
+    r.reserved.Disk_bytes-=request.Disk_bytes
+}
@@ -0,0 +1,159 @@
+package main;
+
+import "encoding/json"
+import "path/filepath"
+import "net/http"
+import "strings"
+import "sync"
+import "os"
+import "time"
+
+// Finished jobs are remembered until this many more have finished, so clients can still pick up their outcome.
+const MAX_FINISHED_JOBS = 1000
+
+// Every job the server took, from submission until long after it finished. Suspended and paused are only
+// known to RunningJobs and are filled in when asked. Artifacts and their tokens are kept as long as their job.
+type JobHistory struct{
+    mutex *sync.Mutex
+    jobs map[string]JobStatusMessage
+    finished *[]string
+    artifact_path string
+    artifact_tokens map[string]string
+}
+
+func new_job_history(artifact_path string) JobHistory{
+    return JobHistory{mutex: &sync.Mutex{}, jobs: make(map[string]JobStatusMessage), finished: &[]string{}, artifact_path: artifact_path, artifact_tokens: make(map[string]string)}
+}
+
+func (h JobHistory) set(status JobStatusMessage){
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    h.jobs[status.Job]=status
+    if status.State!=JOB_STATE_FINISHED{
+        return
+    }
+
+    *h.finished=append(*h.finished, status.Job)
+    for len(*h.finished)>MAX_FINISHED_JOBS{
+        oldest:=h.jobs[(*h.finished)[0]]
+        if len(oldest.Artifacts)!=0{
+            err:=os.Remove(artifact_archive_path(h.artifact_path, oldest.Job))
+            if err!=nil{
+                log_error("Error removing artifacts", err, "job", oldest.Job)
+            }
+        }
+        delete(h.jobs, (*h.finished)[0])
+        delete(h.artifact_tokens, (*h.finished)[0])
+        *h.finished=(*h.finished)[1:]
+    }
+}
+
+func (h JobHistory) started(id string, start_time time.Time){
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    status, ok:=h.jobs[id]
+    if ok{
+        status.State=JOB_STATE_RUNNING
+        status.Started_unix=start_time.Unix()
+        h.jobs[id]=status
+    }
+}
+
+func (h JobHistory) set_artifact_token(id string, token string){
+    if len(token)==0{
+        return
+    }
+
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    h.artifact_tokens[id]=token
+}
+
+func (h JobHistory) artifact_token(id string) (string, bool){
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    token, ok:=h.artifact_tokens[id]
+    return token, ok
+}
+
+// The history starts empty, so archives left by an earlier run belong to no job anyone can ask for.
+func (h JobHistory) prune_artifacts(){
+    entries, err:=os.ReadDir(h.artifact_path)
+    if err!=nil{
+        log_error("Error listing artifacts", err, "path", h.artifact_path)
+        return
+    }
+
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    for _,entry:=range entries{
+        job_id, is_archive:=strings.CutSuffix(entry.Name(), ".tar.gz")
+        _, known:=h.jobs[job_id]
+        if known && is_archive{
+            continue
+        }
+
+        err=os.Remove(filepath.Join(h.artifact_path, entry.Name()))
+        if err!=nil{
+            log_error("Error removing artifacts", err, "file", entry.Name())
+        }
+    }
+}
+
+func (h JobHistory) get(id string) (JobStatusMessage, bool){
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    status, ok:=h.jobs[id]
+    return status, ok
+}
+
+func (r RunningJobs) state(id string) (string, bool){
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    job, ok:=r.jobs[id]
+    switch{
+    case !ok:
+        return "", false
+    case job.suspended:
+        return JOB_STATE_SUSPENDED, true
+    case job.paused:
+        return JOB_STATE_PAUSED, true
+    }
+    return JOB_STATE_RUNNING, true
+}
+
+
+
+
+type JobStatus struct{
+    running RunningJobs
+    history JobHistory
+}
+
+func (j JobStatus) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    job_id:=r.PathValue("id")
+    status, ok:=j.history.get(job_id)
+    if !ok{
+        write_error(w, http.StatusNotFound, new_error_message(ERROR_UNKNOWN_JOB, "no such job, or it finished too long ago", error_details(nil, "job", job_id)))
+        return
+    }
+
+    if status.State==JOB_STATE_RUNNING{
+        state, ok:=j.running.state(job_id)
+        if ok{
+            status.State=state
+        }
+        status.Duration_seconds=time.Since(time.Unix(status.Started_unix, 0)).Seconds()
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    err:=json.NewEncoder(w).Encode(&status)
+    if err!=nil{
+        log_error("Error encoding job status", err)
+    }
+    return
+}
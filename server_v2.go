@@ -0,0 +1,199 @@
+package main;
+
+import "encoding/json"
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "errors"
+import "bytes"
+import "mime"
+import "fmt"
+import "io"
+
+const MAX_WORK_BODY_BYTES = 64*1024
+const MAX_JOB_CONTROL_BODY_BYTES = 4*1024
+const MAX_CLAIM_BODY_BYTES = 4*1024
+
+type InvalidMessage struct{
+    reason string
+}
+
+func (i InvalidMessage) Error() string{
+    return fmt.Sprintf("InvalidMessage(%s)", i.reason)
+}
+
+func is_decimal(value string) bool{
+    if len(value)==0{
+        return false
+    }
+    for _,c:=range value{
+        if c<'0' || c>'9'{
+            return false
+        }
+    }
+    return true
+}
+
+// Job ids and leases are 16 lowercase hex digits.
+func is_id(value string) bool{
+    if len(value)!=16{
+        return false
+    }
+    for _,c:=range value{
+        if (c<'0' || c>'9') && (c<'a' || c>'f'){
+            return false
+        }
+    }
+    return true
+}
+
+func validate_signed(nonce uint64, signature_r string, signature_s string) error{
+    if nonce==0{
+        return InvalidMessage{reason: "nonce is required"}
+    }
+    if !is_decimal(signature_r) || !is_decimal(signature_s){
+        return InvalidMessage{reason: "signature must be decimal"}
+    }
+    return nil
+}
+
+func validate_command(value interface{}) error{
+    command:=value.(*Command)
+    // Relative paths are relative to where the server runs, as they always were on /api/work.
+    if len(command.Work_path)==0 || strings.ContainsRune(command.Work_path, 0){
+        return InvalidMessage{reason: "work_path must not be empty"}
+    }
+    if len(command.Lease)!=0 && !is_id(command.Lease){
+        return InvalidMessage{reason: "lease must be 16 lowercase hex digits"}
+    }
+    if command.Limits!=nil && command.Limits.Cpus<0{
+        return InvalidMessage{reason: "limits.cpus must not be negative"}
+    }
+    err:=validate_artifacts(command.JobOptions)
+    if err!=nil{
+        return InvalidMessage{reason: err.Error()}
+    }
+    return validate_signed(command.Nonce, command.Signature_r, command.Signature_s)
+}
+
+func validate_claim(value interface{}) error{
+    claim_request:=value.(*ClaimRequest)
+    if claim_request.Timestamp_ms<=0 || claim_request.Random==0{
+        return InvalidMessage{reason: "timestamp_ms and random are required"}
+    }
+    if !is_decimal(claim_request.Signature_r) || !is_decimal(claim_request.Signature_s){
+        return InvalidMessage{reason: "signature must be decimal"}
+    }
+    return nil
+}
+
+func validate_job_control(value interface{}) error{
+    control_message:=value.(*JobControlMessage)
+    return validate_signed(control_message.Nonce, control_message.Signature_r, control_message.Signature_s)
+}
+
+// Wraps a handler for /api/v2: only the given method, JSON bodies no bigger than max_body_bytes that decode into
+// what new_message returns without unknown fields and pass validate. GET routes have no body and also answer HEAD.
+// The handler gets the body again, as it was sent. With leases set, a refused body that names a lease gives
+// its slot back instead of holding it until the lease expires.
+type StrictRoute struct{
+    handler http.Handler
+    method string
+    new_message func() interface{}
+    validate func(interface{}) error
+    max_body_bytes int64
+    leases *Leases
+    busy Busy
+}
+
+// Read leniently, the body may be the reason it was refused.
+func (s StrictRoute) release_lease(body []byte){
+    if s.leases==nil{
+        return
+    }
+    lease_message:=struct{
+        Lease string `json:"lease"`
+    }{}
+    json.Unmarshal(body, &lease_message)
+    if is_id(lease_message.Lease){
+        s.leases.release(lease_message.Lease, s.busy)
+    }
+}
+
+func (s StrictRoute) ServeHTTP(w http.ResponseWriter,r *http.Request){
+    refused:=true
+    var body []byte
+    defer func(){
+        if refused{
+            s.release_lease(body)
+        }
+    }()
+
+    if r.Method!=s.method && !(s.method==http.MethodGet && r.Method==http.MethodHead){
+        if s.leases!=nil{
+            body, _=ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.max_body_bytes))
+        }
+        w.Header().Set("Allow", s.method)
+        write_error(w, http.StatusMethodNotAllowed, new_error_message(ERROR_METHOD_NOT_ALLOWED, "method not allowed", error_details(nil, "allow", s.method)))
+        return
+    }
+
+    job_id:=r.PathValue("id")
+    if len(job_id)!=0 && !is_id(job_id){
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "job id must be 16 lowercase hex digits", error_details(nil, "job", job_id)))
+        return
+    }
+
+    if s.new_message==nil{
+        refused=false
+        s.handler.ServeHTTP(w, r)
+        return
+    }
+
+    body, err:=ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.max_body_bytes))
+    if err!=nil{
+        var max_bytes_error *http.MaxBytesError
+        if errors.As(err, &max_bytes_error){
+            write_error(w, http.StatusRequestEntityTooLarge, new_error_message(ERROR_BODY_TOO_LARGE, "body is too large", error_details(nil, "max_bytes", fmt.Sprint(s.max_body_bytes))))
+            return
+        }
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "could not read body", error_details(err)))
+        return
+    }
+
+    media_type, _, err:=mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if err!=nil || media_type!="application/json"{
+        write_error(w, http.StatusUnsupportedMediaType, new_error_message(ERROR_UNSUPPORTED_MEDIA_TYPE, "body must be application/json", nil))
+        return
+    }
+
+    message:=s.new_message()
+    decoder:=json.NewDecoder(bytes.NewReader(body))
+    decoder.DisallowUnknownFields()
+    err=decoder.Decode(message)
+    if err==nil && decoder.Decode(&struct{}{})!=io.EOF{
+        err=InvalidMessage{reason: "trailing data after the message"}
+    }
+    if err!=nil{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "could not decode body", error_details(err)))
+        return
+    }
+
+    err=s.validate(message)
+    if err!=nil{
+        write_error(w, http.StatusBadRequest, new_error_message(ERROR_MALFORMED_REQUEST, "invalid value in body", error_details(err)))
+        return
+    }
+
+    refused=false
+    r.Body=ioutil.NopCloser(bytes.NewReader(body))
+    s.handler.ServeHTTP(w, r)
+}
+
+func get_route(handler http.Handler) StrictRoute{
+    return StrictRoute{handler: handler, method: http.MethodGet}
+}
+
+func post_route(handler http.Handler, new_message func() interface{}, validate func(interface{}) error, max_body_bytes int64) StrictRoute{
+    return StrictRoute{handler: handler, method: http.MethodPost, new_message: new_message, validate: validate, max_body_bytes: max_body_bytes}
+}
@@ -1,18 +1,295 @@
 package main;
 
+import "encoding/json"
+import "fmt"
 
+const JOB_OUTCOME_SUCCEEDED = "succeeded"
+const JOB_OUTCOME_FAILED = "failed"
+const JOB_OUTCOME_OOM_KILLED = "oom_killed"
+
+// Bump PROTOCOL_VERSION whenever what goes over the wire changes, and MIN_PROTOCOL_VERSION when the oldest
+// peer this build can still talk to changes. Servers from before /api/health speak protocol 1.
+const PROTOCOL_VERSION = 10
+const MIN_PROTOCOL_VERSION = 1
+const LEGACY_PROTOCOL_VERSION = 1
+
+// Features a server may or may not have, clients check for them instead of comparing versions.
+const FEATURE_JOB_OPTIONS = "job_options"
+const FEATURE_INFO = "info"
+const FEATURE_JOB_CONTROL = "job_control"
+const FEATURE_METRICS = "metrics"
+const FEATURE_STRUCTURED_ERRORS = "structured_errors"
+const FEATURE_API_V2 = "api_v2"
+// Claims are signed since protocol 9, servers that took unsigned ones said "claim".
+const FEATURE_CLAIM = "signed_claim"
+const FEATURE_EVENTS = "events"
+const FEATURE_JOB_STATUS = "job_status"
+// Artifacts take the token of the job that made them since protocol 10, servers that handed them to anyone
+// said "artifacts".
+const FEATURE_ARTIFACTS = "artifact_tokens"
+
+type HealthMessage struct{
+    Version string `json:"version"`
+    Protocol_version int `json:"protocol_version"`
+    Min_protocol_version int `json:"min_protocol_version"`
+    Features []string `json:"features"`
+}
+
+// What a server without /api/health is assumed to be.
+func legacy_health() HealthMessage{
+    return HealthMessage{
+        Version: "unknown",
+        Protocol_version: LEGACY_PROTOCOL_VERSION,
+        Min_protocol_version: LEGACY_PROTOCOL_VERSION,
+        Features: []string{},
+    }
+}
+
+// Both sides have to be able to speak a common protocol version.
+func (h HealthMessage) is_compatible() bool{
+    return h.Min_protocol_version<=PROTOCOL_VERSION && h.Protocol_version>=MIN_PROTOCOL_VERSION
+}
+
+func (h HealthMessage) supports(feature string) bool{
+    for _,supported:=range h.Features{
+        if supported==feature{
+            return true
+        }
+    }
+    return false
+}
+
+type IncompatibleProtocol struct{
+    host string
+    protocol_version int
+    min_protocol_version int
+}
+
+func (i IncompatibleProtocol) Error() string{
+    return fmt.Sprintf("IncompatibleProtocol(host=%s)(server=%d..%d)(client=%d..%d)", i.host, i.min_protocol_version, i.protocol_version, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)
+}
+
+const ERROR_MALFORMED_REQUEST = "malformed_request"
+const ERROR_INVALID_REQUEST = "invalid_request"
+const ERROR_UNAUTHORIZED = "unauthorized"
+const ERROR_STALE_NONCE = "stale_nonce"
+const ERROR_LEASE_EXPIRED = "lease_expired"
+const ERROR_ROOT_NOT_ALLOWED = "root_not_allowed"
+const ERROR_ISOLATION_UNAVAILABLE = "isolation_unavailable"
+const ERROR_IN_USE = "in_use"
+const ERROR_INSUFFICIENT_RESOURCES = "insufficient_resources"
+const ERROR_BUSY = "busy"
+const ERROR_TOO_MANY_LEASES = "too_many_leases"
+const ERROR_CLOCK_SKEW = "clock_skew"
+const ERROR_UNKNOWN_JOB = "unknown_job"
+const ERROR_NOT_FOUND = "not_found"
+const ERROR_METHOD_NOT_ALLOWED = "method_not_allowed"
+const ERROR_BODY_TOO_LARGE = "body_too_large"
+const ERROR_UNSUPPORTED_MEDIA_TYPE = "unsupported_media_type"
+const ERROR_INTERNAL = "internal_error"
+
+// Retryable errors may go away if the same request is sent again later, the others will not.
+var RETRYABLE_ERRORS = map[string]bool{
+    ERROR_STALE_NONCE: true,
+    ERROR_LEASE_EXPIRED: true,
+    ERROR_IN_USE: true,
+    ERROR_INSUFFICIENT_RESOURCES: true,
+    ERROR_BUSY: true,
+    ERROR_TOO_MANY_LEASES: true,
+    ERROR_INTERNAL: true,
+}
+
+// Every endpoint answers errors with this, Code is one of the ERROR_ constants.
+type ErrorMessage struct{
+    Code string `json:"code"`
+    Message string `json:"message"`
+    Retryable bool `json:"retryable"`
+    Details map[string]string `json:"details,omitempty"`
+}
+
+func new_error_message(code string, message string, details map[string]string) ErrorMessage{
+    return ErrorMessage{Code: code, Message: message, Retryable: RETRYABLE_ERRORS[code], Details: details}
+}
 
 type NonceMessage struct{
     Nonce uint64 `json:"nonce"`
 }
 
 
+// Claims are signed, so only clients with the key can hold slots, but need no nonce fetched first: they are
+// signed over the client's clock and a random value, which the server takes only once.
+type ClaimRequest struct{
+    Timestamp_ms int64 `json:"timestamp_ms"`
+    Random uint64 `json:"random"`
+    Signature_r string `json:"signature_r"`
+    Signature_s string `json:"signature_s"`
+}
+
+func (c ClaimRequest) string_to_sign() string{
+    return fmt.Sprintf("$$claim$$%d$$%x$$", c.Timestamp_ms, c.Random)
+}
+
+// The lease holds a slot until it expires or work is submitted for it, that work is signed over the challenge.
+type ClaimMessage struct{
+    Lease string `json:"lease"`
+    Challenge uint64 `json:"challenge"`
+    Expires_in_ms int64 `json:"expires_in_ms"`
+}
+
+const EVENT_SLOT_FREED = "slot_freed"
+const EVENT_JOB_FINISHED = "job_finished"
+const EVENT_DRAIN = "drain"
+
+// Slot is set for slot_freed and job_finished, Job, Work_path, Outcome and Exit_code only for job_finished and
+// Draining only for drain, which is sent when the server stops taking jobs (Draining true) and when it takes them again.
+type EventMessage struct{
+    Type string `json:"type"`
+    Slot int `json:"slot"`
+    Job string `json:"job,omitempty"`
+    Work_path string `json:"work_path,omitempty"`
+    Outcome string `json:"outcome,omitempty"`
+    Exit_code *int `json:"exit_code,omitempty"`
+    Draining bool `json:"draining"`
+}
+
+// What the server answers when it takes work.
+// Only the submitter learns the artifact token, which jobs with outputs get.
+type WorkMessage struct{
+    Job string `json:"job"`
+    Artifact_token string `json:"artifact_token,omitempty"`
+}
+
+const JOB_STATE_STARTING = "starting"
+const JOB_STATE_RUNNING = "running"
+const JOB_STATE_SUSPENDED = "suspended"
+const JOB_STATE_PAUSED = "paused"
+const JOB_STATE_FINISHED = "finished"
+
+// Outcome and Exit_code are only set once the job finished. Log_path is where the server put the job's output,
+// it is empty if the output went to the server's own.
+type JobStatusMessage struct{
+    Job string `json:"job"`
+    Work_path string `json:"work_path"`
+    State string `json:"state"`
+    Outcome string `json:"outcome,omitempty"`
+    Exit_code *int `json:"exit_code,omitempty"`
+    Started_unix int64 `json:"started_unix,omitempty"`
+    Duration_seconds float64 `json:"duration_seconds"`
+    Log_path string `json:"log_path,omitempty"`
+    Artifacts []string `json:"artifacts,omitempty"`
+}
+
 type BusyMessage struct{
     Busy bool `json:"busy"`
+    Paused bool `json:"paused"`
+}
+
+// Free and used memory and disk are in bytes, the disk is the server's scratch filesystem.
+type InfoMessage struct{
+    Version string `json:"version"`
+    Uptime_seconds int64 `json:"uptime_seconds"`
+    Cpus int `json:"cpus"`
+    Load_averages [3]float64 `json:"load_averages"`
+    Memory_total_bytes uint64 `json:"memory_total_bytes"`
+    Memory_available_bytes uint64 `json:"memory_available_bytes"`
+    Disk_total_bytes uint64 `json:"disk_total_bytes"`
+    Disk_free_bytes uint64 `json:"disk_free_bytes"`
+    Slots int `json:"slots"`
+    Slots_used int `json:"slots_used"`
+    Busy bool `json:"busy"`
+    Paused bool `json:"paused"`
+    Labels map[string]string `json:"labels"`
+    Capacity JobResources `json:"capacity"`
+    Reserved JobResources `json:"reserved"`
+}
+
+// What a job needs, the server admits it only if enough of its capacity is still unreserved.
+type JobResources struct{
+    Cpus float64 `json:"cpus,omitempty"`
+    Memory_bytes uint64 `json:"memory_bytes,omitempty"`
+    Disk_bytes uint64 `json:"disk_bytes,omitempty"`
+}
+
+type JobLimits struct{
+    Cpus float64 `json:"cpus,omitempty"`
+    Memory_bytes uint64 `json:"memory_bytes,omitempty"`
+    Max_processes uint64 `json:"max_processes,omitempty"`
+    Max_open_files uint64 `json:"max_open_files,omitempty"`
+}
+
+// Io_class is one of "realtime", "best-effort" or "idle", as for ionice.
+type JobScheduling struct{
+    Nice int `json:"nice,omitempty"`
+    Io_class string `json:"io_class,omitempty"`
+    Io_priority int `json:"io_priority,omitempty"`
+}
+
+// A finished job on another server whose artifacts a job needs.
+type ArtifactSource struct{
+    Host string `json:"host"`
+    Job string `json:"job"`
+    Token string `json:"token"`
+}
+
+// Everything in here is covered by the signature. Outputs are globs relative to the work path, collected
+// once the job succeeded. Inputs are fetched into the work path before the job starts.
+type JobOptions struct{
+    Limits *JobLimits `json:"limits,omitempty"`
+    Isolate bool `json:"isolate,omitempty"`
+    Env map[string]string `json:"env,omitempty"`
+    Scheduling *JobScheduling `json:"scheduling,omitempty"`
+    Resources *JobResources `json:"resources,omitempty"`
+    Outputs []string `json:"outputs,omitempty"`
+    Inputs []ArtifactSource `json:"inputs,omitempty"`
+}
+
+func (o JobOptions) is_empty() bool{
+    return o.Limits==nil && !o.Isolate && len(o.Env)==0 && o.Scheduling==nil && o.Resources==nil && len(o.Outputs)==0 && len(o.Inputs)==0
+}
+
+func (o JobOptions) has_artifacts() bool{
+    return len(o.Outputs)!=0 || len(o.Inputs)!=0
 }
 
+// Nonce is the one the signature was made with, so the server can tell a stale nonce from a bad signature.
+// Older clients leave it out. Work for a claimed Lease is signed over its challenge, which goes in Nonce.
 type Command struct{
     Work_path string `json:"work_path"`
+    Nonce uint64 `json:"nonce,omitempty"`
+    Lease string `json:"lease,omitempty"`
     Signature_r string `json:"signature_r"`
     Signature_s string `json:"signature_s"`
-}
\ No newline at end of file
+    JobOptions
+}
+
+// Commands without options sign the same string as they always did.
+func (c Command) string_to_sign(nonce uint64) (string, error){
+    string_to_sign:=fmt.Sprintf("$$%s$$%x$$", c.Work_path, nonce)
+
+    options_in_bytes, err:=json.Marshal(&c.JobOptions)
+    if err!=nil{
+        return "", err
+    }
+
+    if string(options_in_bytes)=="{}"{
+        return string_to_sign, nil
+    }
+
+    return fmt.Sprintf("%s%s$$", string_to_sign, options_in_bytes), nil
+}
+
+
+const JOB_CONTROL_SUSPEND = "suspend"
+const JOB_CONTROL_RESUME = "resume"
+
+// Keep_slot only matters when suspending, a suspended job that gave its slot up needs a free one to resume.
+type JobControlMessage struct{
+    Keep_slot bool `json:"keep_slot"`
+    Nonce uint64 `json:"nonce,omitempty"`
+    Signature_r string `json:"signature_r"`
+    Signature_s string `json:"signature_s"`
+}
+
+func (j JobControlMessage) string_to_sign(action string, job_id string, nonce uint64) string{
+    return fmt.Sprintf("$$job_control$$%s$$%s$$%x$$%t$$", action, job_id, nonce, j.Keep_slot)
+}